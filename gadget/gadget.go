@@ -1,39 +1,79 @@
 // Package gadget holds reusable in-circuit building blocks for account-based
-// state machines: an account commitment and a Merkle-membership check that binds
-// an account to a tree root. The rollup circuit is built from these; they are
+// state machines: an account commitment, a Merkle-membership check that binds
+// an account to a tree root, and leaf updates that derive a new root from an
+// old one along a single path per written leaf, compressing each tree node with
+// one permutation of the hash. The rollup circuit is built from these; they are
 // exported so other circuits can reuse them directly.
 package gadget
 
 import (
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/std/accumulator/merkle"
 	"github.com/consensys/gnark/std/hash"
 	"github.com/consensys/gnark/std/signature/eddsa"
 )
 
 // Account is the in-circuit representation of an account. Its commitment is the
-// value stored at the account's Merkle leaf.
+// value stored at the account's Merkle leaf, and Index is the position of that
+// leaf.
+//
+// Balances holds one balance per token; its length must be a power of two. The
+// balances are the leaves of a per-account token subtree whose root is what the
+// account commits to, so a single token balance can be proven against the
+// account without revealing the others.
 type Account struct {
-	Index   frontend.Variable
-	Nonce   frontend.Variable
-	Balance frontend.Variable
-	PubKey  eddsa.PublicKey
+	Index    frontend.Variable
+	Nonce    frontend.Variable
+	Balances []frontend.Variable
+	PubKey   eddsa.PublicKey
 }
 
-// Commit returns the MiMC commitment H(index || nonce || balance || pubKeyX ||
-// pubKeyY). The hasher is reset before use.
-func (a Account) Commit(h hash.FieldHasher) frontend.Variable {
+// NewAccount returns an Account template with room for nbTokens balances, for
+// sizing a circuit before compilation.
+func NewAccount(nbTokens int) Account {
+	return Account{Balances: make([]frontend.Variable, nbTokens)}
+}
+
+// Commit returns the commitment H(nonce || tokenRoot || pubKeyX || pubKeyY),
+// where H is h and tokenRoot is TokenRoot of the balances. The index is not
+// committed: it is the position the commitment is proven at. The hasher is
+// reset before use.
+func (a Account) Commit(h hash.StateStorer) frontend.Variable {
+	tokenRoot := TokenRoot(h, a.Balances)
 	h.Reset()
-	h.Write(a.Index, a.Nonce, a.Balance, a.PubKey.A.X, a.PubKey.A.Y)
+	h.Write(a.Nonce, tokenRoot, a.PubKey.A.X, a.PubKey.A.Y)
 	return h.Sum()
 }
 
+// KeyIndex returns the position of pub's leaf in a tree of the given depth: the
+// low depth bits of H(pubKeyX || pubKeyY), where H is h. The hash is decomposed
+// into its canonical bits, so the position is the only one a key can take.
+// The hasher is reset before use.
+func KeyIndex(api frontend.API, h hash.StateStorer, pub eddsa.PublicKey, depth int) frontend.Variable {
+	h.Reset()
+	h.Write(pub.A.X, pub.A.Y)
+	bits := api.ToBinary(h.Sum())
+	return api.FromBinary(bits[:depth]...)
+}
+
+// TokenRoot returns the root of the binary Merkle tree whose leaves are
+// balances, each inner node being Compress of its children. A single balance is
+// its own root. len(balances) must be a power of two.
+func TokenRoot(h hash.StateStorer, balances []frontend.Variable) frontend.Variable {
+	level := balances
+	for len(level) > 1 {
+		next := make([]frontend.Variable, len(level)/2)
+		for i := range next {
+			next[i] = Compress(h, level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
 // VerifyMembership asserts that a is committed at index a.Index in the Merkle
-// tree whose root is root, using proof. It (1) binds the account commitment to
-// the proof's leaf (proof.Path[0]), (2) binds the proof to the public root, and
-// (3) checks the inclusion proof.
-func VerifyMembership(api frontend.API, h hash.FieldHasher, a Account, proof merkle.MerkleProof, root frontend.Variable) {
-	api.AssertIsEqual(a.Commit(h), proof.Path[0])
-	api.AssertIsEqual(proof.RootHash, root)
-	proof.VerifyProof(api, h, a.Index)
+// tree whose root is root, path being the leaf's siblings. The tree is laid out
+// as for MerklePath, with the commitments as its bottom nodes and Compress
+// inner nodes, the layout of the rollup's state tree.
+func VerifyMembership(api frontend.API, h hash.StateStorer, a Account, path MerklePath, root frontend.Variable) {
+	api.AssertIsEqual(path.Root(api, h, a.Index, a.Commit(h)), root)
 }
@@ -1,27 +1,27 @@
 package gadget
 
 import (
-	"bytes"
+	"encoding/binary"
 	stdhash "hash"
 	"math/rand"
 	"testing"
 
-	"github.com/consensys/gnark-crypto/accumulator/merkletree"
 	"github.com/consensys/gnark-crypto/ecc"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	ceddsa "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
 	tedwards "github.com/consensys/gnark-crypto/ecc/twistededwards"
+	chash "github.com/consensys/gnark-crypto/hash"
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/std/accumulator/merkle"
 	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/signature/eddsa"
 	"github.com/consensys/gnark/test"
 )
 
 // membershipCircuit exercises the gadget in isolation.
 type membershipCircuit struct {
 	Account Account
-	Proof   merkle.MerkleProof
+	Path    MerklePath
 	Root    frontend.Variable `gnark:",public"`
 }
 
@@ -30,27 +30,61 @@ func (c *membershipCircuit) Define(api frontend.API) error {
 	if err != nil {
 		return err
 	}
-	VerifyMembership(api, &h, c.Account, c.Proof, c.Root)
+	VerifyMembership(api, &h, c.Account, c.Path, c.Root)
 	return nil
 }
 
+// nbTokens is the number of token balances per account used in these tests.
+const nbTokens = 4
+
 // nativeAccount mirrors gadget.Account off-circuit, committing the same way.
 type nativeAccount struct {
 	index, nonce uint64
-	balance      fr.Element
+	balances     [nbTokens]fr.Element
 	pub          ceddsa.PublicKey
 }
 
-func (a nativeAccount) commit(h stdhash.Hash) []byte {
+// hashElems returns the MiMC hash of the given field elements.
+func hashElems(h stdhash.Hash, elems ...fr.Element) fr.Element {
 	h.Reset()
-	var idx, non fr.Element
-	idx.SetUint64(a.index)
-	non.SetUint64(a.nonce)
-	for _, e := range []fr.Element{idx, non, a.balance, a.pub.A.X, a.pub.A.Y} {
+	for _, e := range elems {
 		b := e.Bytes()
 		h.Write(b[:])
 	}
-	return h.Sum(nil)
+	var out fr.Element
+	out.SetBytes(h.Sum(nil))
+	return out
+}
+
+// compressElems mirrors Compress off-circuit: h started from the state left
+// absorbs right.
+func compressElems(t *testing.T, h chash.StateStorer, left, right fr.Element) fr.Element {
+	t.Helper()
+	l, r := left.Bytes(), right.Bytes()
+	h.Reset()
+	if err := h.SetState(l[:]); err != nil {
+		t.Fatalf("set state: %v", err)
+	}
+	h.Write(r[:])
+	var out fr.Element
+	out.SetBytes(h.Sum(nil))
+	return out
+}
+
+func (a nativeAccount) commit(t *testing.T, h chash.StateStorer) []byte {
+	level := a.balances[:]
+	for len(level) > 1 {
+		next := make([]fr.Element, len(level)/2)
+		for i := range next {
+			next[i] = compressElems(t, h, level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	var non fr.Element
+	non.SetUint64(a.nonce)
+	c := hashElems(h, non, level[0], a.pub.A.X, a.pub.A.Y)
+	b := c.Bytes()
+	return b[:]
 }
 
 func TestVerifyMembership(t *testing.T) {
@@ -60,47 +94,175 @@ func TestVerifyMembership(t *testing.T) {
 	h := cmimc.NewMiMC()
 
 	accounts := make([]nativeAccount, nbLeaves)
-	var buf bytes.Buffer
-	for i := 0; i < nbLeaves; i++ {
+	for i := range accounts {
 		priv, err := ceddsa.GenerateKey(r)
 		if err != nil {
 			t.Fatalf("key %d: %v", i, err)
 		}
-		a := nativeAccount{index: uint64(i), nonce: uint64(i), pub: priv.PublicKey}
-		a.balance.SetUint64(uint64(100 + i))
-		accounts[i] = a
-		buf.Write(a.commit(h)) // 32-byte leaf per account
+		accounts[i] = nativeAccount{index: uint64(i), nonce: uint64(i), pub: priv.PublicKey}
+		for j := range accounts[i].balances {
+			accounts[i].balances[j].SetUint64(uint64(100*j + i))
+		}
+	}
+	root, path := treeRootPath(t, h, accounts, target)
+
+	circuit := &membershipCircuit{Account: NewAccount(nbTokens), Path: NewMerklePath(len(path.Siblings))}
+	assignment := &membershipCircuit{Account: assignAccount(accounts[target]), Path: path, Root: root}
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("gadget should verify a valid membership proof: %v", err)
+	}
+
+	// Tampering with any token balance breaks the commitment -> root mismatch.
+	bad := *assignment
+	bad.Account.Balances = append([]frontend.Variable(nil), assignment.Account.Balances...)
+	bad.Account.Balances[nbTokens-1] = fr.NewElement(999999)
+	if err := test.IsSolved(circuit, &bad, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("gadget accepted a tampered account, but should not")
+	}
+}
+
+// keyIndexCircuit checks KeyIndex against the expected position.
+type keyIndexCircuit struct {
+	PubKey eddsa.PublicKey
+	Index  frontend.Variable `gnark:",public"`
+	depth  int
+}
+
+func (c *keyIndexCircuit) Define(api frontend.API) error {
+	h, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(KeyIndex(api, &h, c.PubKey, c.depth), c.Index)
+	return nil
+}
+
+func TestKeyIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(8)) //#nosec G404 -- deterministic test
+	priv, err := ceddsa.GenerateKey(r)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	k := hashElems(cmimc.NewMiMC(), priv.PublicKey.A.X, priv.PublicKey.A.Y)
+	b := k.Bytes()
+	full := binary.BigEndian.Uint64(b[fr.Bytes-8:])
+
+	for _, depth := range []int{1, 8, 64} {
+		index := full
+		if depth < 64 {
+			index &= 1<<depth - 1
+		}
+		circuit := &keyIndexCircuit{depth: depth}
+		assignment := &keyIndexCircuit{Index: index}
+		assignment.PubKey.Assign(tedwards.BN254, priv.PublicKey.Bytes())
+		if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+			t.Fatalf("depth %d: KeyIndex should give the low bits of the key hash: %v", depth, err)
+		}
+		assignment.Index = index ^ 1
+		if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err == nil {
+			t.Fatalf("depth %d: KeyIndex accepted another position", depth)
+		}
 	}
+}
+
+// updateCircuit applies two account updates in sequence.
+type updateCircuit struct {
+	First, Second AccountUpdate
+	Root          frontend.Variable `gnark:",public"`
+	NewRoot       frontend.Variable `gnark:",public"`
+}
 
-	root, proofPath, numLeaves, err := merkletree.BuildReaderProof(&buf, h, h.Size(), target)
+func (c *updateCircuit) Define(api frontend.API) error {
+	h, err := mimc.NewMiMC(api)
 	if err != nil {
-		t.Fatalf("build proof: %v", err)
+		return err
+	}
+	_, newRoot := UpdateAccounts(api, &h, c.Root, c.First, c.Second)
+	api.AssertIsEqual(newRoot, c.NewRoot)
+	return nil
+}
+
+// assignAccount returns the circuit assignment of a.
+func assignAccount(a nativeAccount) Account {
+	acc := Account{Index: a.index, Nonce: a.nonce, Balances: make([]frontend.Variable, nbTokens)}
+	for j := range acc.Balances {
+		acc.Balances[j] = a.balances[j]
+	}
+	acc.PubKey.Assign(tedwards.BN254, a.pub.Bytes())
+	return acc
+}
+
+// treeRootPath returns the root of the tree over the accounts' commitments,
+// whose inner nodes are compressions of their children, and the siblings of
+// leaf i. len(accounts) must be a power of two.
+func treeRootPath(t *testing.T, h chash.StateStorer, accounts []nativeAccount, i uint64) (fr.Element, MerklePath) {
+	t.Helper()
+	level := make([]fr.Element, len(accounts))
+	for k, a := range accounts {
+		level[k].SetBytes(a.commit(t, h))
 	}
-	if !merkletree.VerifyProof(h, root, proofPath, target, numLeaves) {
-		t.Fatal("native proof must verify")
+	var path MerklePath
+	for ; len(level) > 1; i /= 2 {
+		path.Siblings = append(path.Siblings, level[i^1])
+		next := make([]fr.Element, len(level)/2)
+		for k := range next {
+			next[k] = compressElems(t, h, level[2*k], level[2*k+1])
+		}
+		level = next
 	}
+	return level[0], path
+}
 
-	circuit := &membershipCircuit{Proof: merkle.MerkleProof{Path: make([]frontend.Variable, len(proofPath))}}
+func TestUpdateAccounts(t *testing.T) {
+	const nbLeaves = 16
+	r := rand.New(rand.NewSource(6)) //#nosec G404 -- deterministic test
+	h := cmimc.NewMiMC()
 
-	assignment := &membershipCircuit{Root: root}
-	assignment.Account.Index = accounts[target].index
-	assignment.Account.Nonce = accounts[target].nonce
-	assignment.Account.Balance = accounts[target].balance
-	assignment.Account.PubKey.Assign(tedwards.BN254, accounts[target].pub.Bytes())
-	assignment.Proof.RootHash = root
-	assignment.Proof.Path = make([]frontend.Variable, len(proofPath))
-	for i := range proofPath {
-		assignment.Proof.Path[i] = proofPath[i]
+	accounts := make([]nativeAccount, nbLeaves)
+	for i := range accounts {
+		priv, err := ceddsa.GenerateKey(r)
+		if err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+		accounts[i] = nativeAccount{index: uint64(i), pub: priv.PublicKey}
+		accounts[i].balances[0].SetUint64(100)
 	}
 
+	// move 30 from account 3 to account 10, one leaf write at a time
+	sender, receiver := accounts[3], accounts[10]
+	root, senderPath := treeRootPath(t, h, accounts, 3)
+	_, staleReceiverPath := treeRootPath(t, h, accounts, 10)
+	accounts[3].nonce++
+	accounts[3].balances[0].SetUint64(70)
+	_, receiverPath := treeRootPath(t, h, accounts, 10)
+	accounts[10].balances[0].SetUint64(130)
+	newRoot, _ := treeRootPath(t, h, accounts, 0)
+
+	circuit := &updateCircuit{
+		First:  AccountUpdate{Before: NewAccount(nbTokens), After: NewAccount(nbTokens), Path: NewMerklePath(len(senderPath.Siblings))},
+		Second: AccountUpdate{Before: NewAccount(nbTokens), After: NewAccount(nbTokens), Path: NewMerklePath(len(senderPath.Siblings))},
+	}
+	assignment := &updateCircuit{
+		First:   AccountUpdate{Before: assignAccount(sender), After: assignAccount(accounts[3]), Path: senderPath},
+		Second:  AccountUpdate{Before: assignAccount(receiver), After: assignAccount(accounts[10]), Path: receiverPath},
+		Root:    root,
+		NewRoot: newRoot,
+	}
 	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
-		t.Fatalf("gadget should verify a valid membership proof: %v", err)
+		t.Fatalf("gadget should verify a sequential two-leaf update: %v", err)
 	}
 
-	// Tampering with the balance breaks the commitment -> leaf mismatch.
+	// the second write must be proven in the tree the first one produced
 	bad := *assignment
-	bad.Account.Balance = fr.NewElement(999999)
+	bad.Second.Path = staleReceiverPath
 	if err := test.IsSolved(circuit, &bad, ecc.BN254.ScalarField()); err == nil {
-		t.Fatal("gadget accepted a tampered account, but should not")
+		t.Fatal("gadget accepted a second path taken before the first write")
+	}
+
+	// an update cannot move an account to another leaf
+	bad = *assignment
+	bad.First.After.Index = 4
+	if err := test.IsSolved(circuit, &bad, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("gadget accepted an update that changes the account index")
 	}
 }
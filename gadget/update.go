@@ -0,0 +1,95 @@
+package gadget
+
+import (
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash"
+)
+
+// MerklePath is the authentication path of one leaf of a Merkle tree whose
+// bottom nodes are the leaves themselves and whose inner nodes are Compress of
+// their children. Siblings lists the leaf's siblings from the bottom level up.
+// Its length is the tree depth.
+//
+// It holds neither the leaf nor the root: writing a leaf leaves its siblings
+// unchanged, so one path proves both the old and the new root of an update.
+type MerklePath struct {
+	Siblings []frontend.Variable
+}
+
+// NewMerklePath returns a MerklePath template for a tree of the given depth,
+// for sizing a circuit before compilation.
+func NewMerklePath(depth int) MerklePath {
+	return MerklePath{Siblings: make([]frontend.Variable, depth)}
+}
+
+// Root returns the root of the tree holding leaf at index. index must be below
+// 2^depth.
+func (p MerklePath) Root(api frontend.API, h hash.StateStorer, index, leaf frontend.Variable) frontend.Variable {
+	path := api.ToBinary(index, len(p.Siblings))
+	root := leaf
+	for l, s := range p.Siblings {
+		root = innerNode(api, h, path[l], root, s)
+	}
+	return root
+}
+
+// Roots returns the root of the tree holding oldLeaf at index and the root of
+// the same tree once newLeaf replaces it. index must be below 2^depth.
+func (p MerklePath) Roots(api frontend.API, h hash.StateStorer, index, oldLeaf, newLeaf frontend.Variable) (oldRoot, newRoot frontend.Variable) {
+	path := api.ToBinary(index, len(p.Siblings))
+	oldRoot, newRoot = oldLeaf, newLeaf
+	for l, s := range p.Siblings {
+		oldRoot = innerNode(api, h, path[l], oldRoot, s)
+		newRoot = innerNode(api, h, path[l], newRoot, s)
+	}
+	return oldRoot, newRoot
+}
+
+// Compress returns the tree node over left and right: h started from the state
+// left absorbs right, one permutation of the hash where H(left || right) takes
+// two. For MiMC it is the Miyaguchi–Preneel step E_left(right) + left + right,
+// for Poseidon2 the width-2 compression function. The hasher is reset before
+// use.
+func Compress(h hash.StateStorer, left, right frontend.Variable) frontend.Variable {
+	h.Reset()
+	if err := h.SetState([]frontend.Variable{left}); err != nil {
+		panic(err) // a reset hasher always takes a one-element state
+	}
+	h.Write(right)
+	return h.Sum()
+}
+
+// innerNode returns the parent of cur and its sibling s, cur being the right
+// child when bit is 1.
+func innerNode(api frontend.API, h hash.StateStorer, bit, cur, s frontend.Variable) frontend.Variable {
+	return Compress(h, api.Select(bit, s, cur), api.Select(bit, cur, s))
+}
+
+// AccountUpdate is one leaf write: the account committed at Before.Index before
+// and after it, and the leaf's path.
+type AccountUpdate struct {
+	Before Account
+	After  Account
+	Path   MerklePath
+}
+
+// UpdateAccount asserts that u.Before is committed at its index in the tree
+// with the given root and returns the root once u.After replaces it. u.After
+// must keep the index. An update with After equal to Before returns root.
+func UpdateAccount(api frontend.API, h hash.StateStorer, root frontend.Variable, u AccountUpdate) frontend.Variable {
+	api.AssertIsEqual(u.After.Index, u.Before.Index)
+	oldRoot, newRoot := u.Path.Roots(api, h, u.Before.Index, u.Before.Commit(h), u.After.Commit(h))
+	api.AssertIsEqual(oldRoot, root)
+	return newRoot
+}
+
+// UpdateAccounts applies two leaf writes in sequence from root: first, then
+// second in the tree first produced, so second's path and Before are taken
+// after first is written. It returns that intermediate root and the final one.
+//
+// Chaining the writes binds the final root to root: it differs from it only in
+// the two leaves, and the two may be the same leaf.
+func UpdateAccounts(api frontend.API, h hash.StateStorer, root frontend.Variable, first, second AccountUpdate) (mid, newRoot frontend.Variable) {
+	mid = UpdateAccount(api, h, root, first)
+	return mid, UpdateAccount(api, h, mid, second)
+}
@@ -173,6 +173,12 @@ func LoadPublicWitness(path string) (witness.Witness, error) {
 // ExportSolidityVerifier writes a Solidity verifier contract for a Groth16
 // verifying key to w. Only BN254 is supported (which is zkkit's curve). The
 // emitted contract verifies proofs produced for the same circuit on-chain.
+//
+// The contract's verifyProof takes the circuit's public inputs in declaration
+// order. A circuit that commits to its public data with a single hash input
+// (such as rollup.WithPublicCommitment) lets the calling contract recompute that
+// hash from calldata and pass one input, which keeps verification gas flat as
+// the public data grows.
 func ExportSolidityVerifier(w io.Writer, vk groth16.VerifyingKey) error {
 	if err := vk.ExportSolidity(w); err != nil {
 		return fmt.Errorf("export solidity verifier: %w", err)
@@ -11,6 +11,7 @@ import (
 	"fmt"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend"
 	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/backend/witness"
 	"github.com/consensys/gnark/constraint"
@@ -51,6 +52,11 @@ func Setup(ccs constraint.ConstraintSystem) (Keys, error) {
 // Prove builds the witness from an assignment and produces a proof. It returns
 // the proof together with the public-only witness needed for verification.
 func Prove(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, assignment frontend.Circuit) (groth16.Proof, witness.Witness, error) {
+	return prove(ccs, pk, assignment)
+}
+
+// prove is Prove with extra backend options.
+func prove(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, assignment frontend.Circuit, opts ...backend.ProverOption) (groth16.Proof, witness.Witness, error) {
 	full, err := frontend.NewWitness(assignment, Curve.ScalarField())
 	if err != nil {
 		return nil, nil, fmt.Errorf("build witness: %w", err)
@@ -59,7 +65,7 @@ func Prove(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, assignment fr
 	if err != nil {
 		return nil, nil, fmt.Errorf("extract public witness: %w", err)
 	}
-	proof, err := groth16.Prove(ccs, pk, full)
+	proof, err := groth16.Prove(ccs, pk, full, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("groth16 prove: %w", err)
 	}
@@ -69,7 +75,12 @@ func Prove(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, assignment fr
 // Verify checks a proof against a verifying key and the public witness. It
 // returns nil if and only if the proof is valid.
 func Verify(proof groth16.Proof, vk groth16.VerifyingKey, publicWitness witness.Witness) error {
-	if err := groth16.Verify(proof, vk, publicWitness); err != nil {
+	return verify(proof, vk, publicWitness)
+}
+
+// verify is Verify with extra backend options.
+func verify(proof groth16.Proof, vk groth16.VerifyingKey, publicWitness witness.Witness, opts ...backend.VerifierOption) error {
+	if err := groth16.Verify(proof, vk, publicWitness, opts...); err != nil {
 		return fmt.Errorf("groth16 verify: %w", err)
 	}
 	return nil
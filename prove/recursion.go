@@ -0,0 +1,30 @@
+package prove
+
+import (
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	stdgroth16 "github.com/consensys/gnark/std/recursion/groth16"
+)
+
+// This file holds the helpers for recursive proofs: inner proofs that another
+// circuit over Curve verifies in-circuit (see rollup.AggregateCircuit).
+//
+// gnark's in-circuit Groth16 verifier hashes the inner proof's commitments with
+// a circuit-friendly hash instead of the native default, so an inner proof must
+// be produced with ProveRecursive and checked natively with VerifyRecursive. The
+// outer (aggregate) circuit is an ordinary circuit over Curve: it is compiled,
+// set up, proven and verified with Compile, Setup, Prove and Verify, and its
+// verifier exports to Solidity like any other.
+
+// ProveRecursive is Prove for a proof that will be verified inside another
+// circuit over Curve.
+func ProveRecursive(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, assignment frontend.Circuit) (groth16.Proof, witness.Witness, error) {
+	return prove(ccs, pk, assignment, stdgroth16.GetNativeProverOptions(Curve.ScalarField(), Curve.ScalarField()))
+}
+
+// VerifyRecursive is Verify for a proof produced by ProveRecursive.
+func VerifyRecursive(proof groth16.Proof, vk groth16.VerifyingKey, publicWitness witness.Witness) error {
+	return verify(proof, vk, publicWitness, stdgroth16.GetNativeVerifierOptions(Curve.ScalarField(), Curve.ScalarField()))
+}
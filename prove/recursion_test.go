@@ -0,0 +1,29 @@
+package prove
+
+import "testing"
+
+func TestProveVerifyRecursive(t *testing.T) {
+	ccs, err := Compile(&doubler{})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	keys, err := Setup(ccs)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	proof, public, err := ProveRecursive(ccs, keys.PK, &doubler{A: 3, B: 6})
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+	if err := VerifyRecursive(proof, keys.VK, public); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	otherProof, _, err := ProveRecursive(ccs, keys.PK, &doubler{A: 4, B: 8})
+	if err != nil {
+		t.Fatalf("prove other: %v", err)
+	}
+	if err := VerifyRecursive(otherProof, keys.VK, public); err == nil {
+		t.Fatal("verify should fail when public inputs differ")
+	}
+}
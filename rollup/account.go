@@ -1,63 +1,138 @@
 // Package rollup is a modern, account-based zk-rollup reference built on gnark
 // v0.15. It provides the off-circuit ("native") types — accounts, transfers, and
-// an operator that maintains a MiMC Merkle state — and the in-circuit Circuit
-// that proves a batch of transfers was applied correctly.
+// an operator that maintains a Merkle state hashed with MiMC or Poseidon2 (see
+// HashSuite) — and the in-circuit Circuit that proves a batch of transfers was
+// applied correctly.
 //
 // It is a direct, modernized descendant of the original gnark-rollup-exp proof
 // of concept, rebuilt against the current gnark standard gadgets.
 package rollup
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"hash"
+	"math/big"
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	chash "github.com/consensys/gnark-crypto/hash"
 )
 
-// SizeAccount is the byte length of a serialized account. The layout is five
-// 32-byte chunks: index||nonce (packed into the first chunk), balance, public
-// key X, public key Y.
-const SizeAccount = 160
+// TokenDepth is the depth of each account's token subtree; an account holds a
+// balance for each of the NbTokens = 2^TokenDepth tokens, identified by
+// TokenID 0..NbTokens-1.
+const TokenDepth = 2
+
+// NbTokens is the number of tokens every account holds a balance for.
+const NbTokens = 1 << TokenDepth
+
+// FeeToken is the token transfer fees are paid in.
+const FeeToken = 0
+
+// SizeAccount is the byte length of a serialized account. The layout is
+// 32-byte big-endian chunks: index, nonce, one balance per token, public key X,
+// public key Y.
+const SizeAccount = 32 * (4 + NbTokens)
+
+// StateDepth is the depth of the state tree. An account's position is
+// StateDepth bits of the hash of its key (see KeyIndex), wide enough that no
+// one can grind a key onto the position of another's.
+const StateDepth = 160
+
+// Index is the position of a leaf in the state tree: a StateDepth-bit unsigned
+// integer, big-endian.
+type Index [StateDepth / 8]byte
+
+// String returns i in hexadecimal.
+func (i Index) String() string {
+	return hex.EncodeToString(i[:])
+}
+
+// compareIndex orders indices as the integers they encode.
+func compareIndex(a, b Index) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// element returns i as a field element, for witness assignment.
+func (i Index) element() fr.Element {
+	var e fr.Element
+	e.SetBytes(i[:])
+	return e
+}
+
+// BalanceBits bounds every balance and amount: they are unsigned integers below
+// 2^BalanceBits, checked natively by the operator and range-checked in-circuit,
+// so the rollup behaves like an integer ledger and no sum can wrap the BN254
+// scalar field.
+const BalanceBits = 64
 
 // ErrSizeByteSlice is returned when a byte slice does not match SizeAccount.
 var ErrSizeByteSlice = errors.New("rollup: byte slice size is inconsistent with account size")
 
 // Account is a rollup account held in the operator's state.
 type Account struct {
-	Index   uint64          // position of the account in the state tree
-	Nonce   uint64          // number of transfers sent from this account
-	Balance fr.Element      // account balance
-	PubKey  eddsa.PublicKey // owner's EdDSA public key
+	Index    Index                // position of the account's leaf, the KeyIndex of its key
+	Nonce    uint64               // number of signed transactions sent from this account
+	Balances [NbTokens]fr.Element // balance per token, each below 2^BalanceBits
+	PubKey   eddsa.PublicKey      // owner's key, checked under the Authorizer
 }
 
 // Reset zeroes an account to a canonical empty value (Y=1 so the point is valid).
 func (a *Account) Reset() {
-	a.Index = 0
+	a.Index = Index{}
 	a.Nonce = 0
-	a.Balance.SetZero()
+	for i := range a.Balances {
+		a.Balances[i].SetZero()
+	}
 	a.PubKey.A.X.SetZero()
 	a.PubKey.A.Y.SetOne()
 }
 
+// IsEmpty reports whether a is an unused slot: the Reset value (identity public
+// key, zero balances, zero nonce) at any index.
+func (a *Account) IsEmpty() bool {
+	for i := range a.Balances {
+		if !a.Balances[i].IsZero() {
+			return false
+		}
+	}
+	return a.Nonce == 0 && a.PubKey.A.X.IsZero() && a.PubKey.A.Y.IsOne()
+}
+
+// emptyAccount returns the canonical empty account at position index: the
+// Reset value with Index set, so an unused leaf is still provable at its
+// position.
+func emptyAccount(index Index) Account {
+	var a Account
+	a.Reset()
+	a.Index = index
+	return a
+}
+
 // Serialize encodes the account as SizeAccount bytes:
-// index||nonce || balance || pubKeyX || pubKeyY, each field big-endian in a
-// 32-byte chunk (index and nonce share the first chunk).
+// index || nonce || balance_0 .. balance_{NbTokens-1} || pubKeyX || pubKeyY,
+// each field big-endian in a 32-byte chunk.
 func (a *Account) Serialize() []byte {
 	var res [SizeAccount]byte
 
-	binary.BigEndian.PutUint64(res[24:32], a.Index)
+	copy(res[32-len(a.Index):32], a.Index[:])
 	binary.BigEndian.PutUint64(res[56:64], a.Nonce)
 
-	bal := a.Balance.Bytes()
-	copy(res[64:96], bal[:])
+	off := 64
+	for i := range a.Balances {
+		bal := a.Balances[i].Bytes()
+		copy(res[off:off+32], bal[:])
+		off += 32
+	}
 
 	x := a.PubKey.A.X.Bytes()
-	copy(res[96:128], x[:])
+	copy(res[off:off+32], x[:])
 
 	y := a.PubKey.A.Y.Bytes()
-	copy(res[128:160], y[:])
+	copy(res[off+32:off+64], y[:])
 
 	return res[:]
 }
@@ -71,18 +146,94 @@ func Deserialize(data []byte) (Account, error) {
 		return a, ErrSizeByteSlice
 	}
 
-	a.Index = binary.BigEndian.Uint64(data[24:32])
+	copy(a.Index[:], data[32-len(a.Index):32])
 	a.Nonce = binary.BigEndian.Uint64(data[56:64])
-	a.Balance.SetBytes(data[64:96])
-	a.PubKey.A.X.SetBytes(data[96:128])
-	a.PubKey.A.Y.SetBytes(data[128:160])
+	off := 64
+	for i := range a.Balances {
+		a.Balances[i].SetBytes(data[off : off+32])
+		off += 32
+	}
+	a.PubKey.A.X.SetBytes(data[off : off+32])
+	a.PubKey.A.Y.SetBytes(data[off+32 : off+64])
 	return a, nil
 }
 
-// Hash returns the MiMC hash of the serialized account, the value stored at the
-// account's Merkle leaf. The hasher is reset before use.
-func (a *Account) Hash(h hash.Hash) []byte {
+// TokenRoot returns the root of the account's token subtree: the binary Merkle
+// tree whose leaves are the balances, each inner node being the compression of
+// its children (see compress). It matches gadget.TokenRoot. The hasher is reset
+// before each node.
+func (a *Account) TokenRoot(h chash.StateStorer) fr.Element {
+	level := a.Balances[:]
+	for len(level) > 1 {
+		next := make([]fr.Element, len(level)/2)
+		for i := range next {
+			l, r := level[2*i].Bytes(), level[2*i+1].Bytes()
+			next[i].SetBytes(compress(h, l[:], r[:]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Hash returns the commitment of the account, the value stored at the
+// account's Merkle leaf: H(nonce || tokenRoot || pubKeyX || pubKeyY), matching
+// gadget.Account.Commit. The index is the leaf's position rather than part of
+// its value, so every empty leaf holds the same commitment. The hasher is
+// reset before use.
+func (a *Account) Hash(h chash.StateStorer) []byte {
+	var nonce fr.Element
+	nonce.SetUint64(a.Nonce)
+	c := hashElements(h, nonce, a.TokenRoot(h), a.PubKey.A.X, a.PubKey.A.Y)
+	b := c.Bytes()
+	return b[:]
+}
+
+// KeyIndex returns the position of the leaf that holds the account of pub: the
+// low StateDepth bits of H(pubKeyX || pubKeyY), matching gadget.KeyIndex with
+// depth StateDepth. The hasher is reset before use.
+func KeyIndex(pub eddsa.PublicKey, h hash.Hash) Index {
+	k := hashElements(h, pub.A.X, pub.A.Y)
+	b := k.Bytes()
+	var i Index
+	copy(i[:], b[fr.Bytes-len(i):])
+	return i
+}
+
+// hashElements returns the hash of the given field elements, each written
+// as a 32-byte big-endian chunk. The hasher is reset before use.
+func hashElements(h hash.Hash, elems ...fr.Element) fr.Element {
 	h.Reset()
-	h.Write(a.Serialize())
-	return h.Sum(nil)
+	for _, e := range elems {
+		b := e.Bytes()
+		h.Write(b[:])
+	}
+	var out fr.Element
+	out.SetBytes(h.Sum(nil))
+	return out
+}
+
+// inRange reports whether every balance of a is below 2^BalanceBits.
+func (a *Account) inRange() bool {
+	for i := range a.Balances {
+		if !inRange(&a.Balances[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange reports whether e, read as an unsigned integer, is below 2^BalanceBits.
+func inRange(e *fr.Element) bool {
+	var b big.Int
+	return e.BigInt(&b).BitLen() <= BalanceBits
+}
+
+// debit subtracts x from the balance b, reporting false (and leaving b
+// unchanged) if b is below x.
+func debit(b, x *fr.Element) bool {
+	if x.Cmp(b) > 0 {
+		return false
+	}
+	b.Sub(b, x)
+	return true
 }
@@ -2,19 +2,30 @@ package rollup
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math/big"
 	"math/rand"
 	"testing"
 
 	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 )
 
+// testIndex returns the index of the leaf at position v.
+func testIndex(v uint64) Index {
+	var i Index
+	binary.BigEndian.PutUint64(i[len(i)-8:], v)
+	return i
+}
+
 func TestAccountSerializeRoundTrip(t *testing.T) {
 	r := rand.New(rand.NewSource(1)) //#nosec G404 -- deterministic test
-	acc, _, err := NewAccount(3, 100, r)
+	acc, _, err := NewAccount(100, r)
 	if err != nil {
 		t.Fatalf("new account: %v", err)
 	}
+	acc.Index = testIndex(3)
 	acc.Nonce = 7
+	acc.Balances[NbTokens-1].SetUint64(9)
 
 	b := acc.Serialize()
 	if len(b) != SizeAccount {
@@ -26,10 +37,10 @@ func TestAccountSerializeRoundTrip(t *testing.T) {
 		t.Fatalf("deserialize: %v", err)
 	}
 	if got.Index != acc.Index || got.Nonce != acc.Nonce {
-		t.Fatalf("index/nonce mismatch: got (%d,%d) want (%d,%d)", got.Index, got.Nonce, acc.Index, acc.Nonce)
+		t.Fatalf("index/nonce mismatch: got (%s,%d) want (%s,%d)", got.Index, got.Nonce, acc.Index, acc.Nonce)
 	}
-	if !got.Balance.Equal(&acc.Balance) {
-		t.Fatal("balance mismatch after round trip")
+	if got.Balances != acc.Balances {
+		t.Fatal("balances mismatch after round trip")
 	}
 	if !got.PubKey.A.X.Equal(&acc.PubKey.A.X) || !got.PubKey.A.Y.Equal(&acc.PubKey.A.Y) {
 		t.Fatal("pubkey mismatch after round trip")
@@ -44,7 +55,7 @@ func TestDeserializeWrongSize(t *testing.T) {
 
 func TestAccountHashDeterministic(t *testing.T) {
 	r := rand.New(rand.NewSource(2)) //#nosec G404 -- deterministic test
-	acc, _, err := NewAccount(1, 50, r)
+	acc, _, err := NewAccount(50, r)
 	if err != nil {
 		t.Fatalf("new account: %v", err)
 	}
@@ -55,9 +66,37 @@ func TestAccountHashDeterministic(t *testing.T) {
 		t.Fatal("account hash is not deterministic")
 	}
 
-	acc.Balance.SetUint64(51)
+	acc.Balances[FeeToken].SetUint64(51)
 	h3 := acc.Hash(h)
 	if bytes.Equal(h1, h3) {
 		t.Fatal("account hash did not change when balance changed")
 	}
 }
+
+func TestAccountHashOmitsIndex(t *testing.T) {
+	h := cmimc.NewMiMC()
+	a, b := emptyAccount(Index{}), emptyAccount(testIndex(5))
+	if !bytes.Equal(a.Hash(h), b.Hash(h)) {
+		t.Fatal("empty leaves must hold the same commitment at every index")
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	h := cmimc.NewMiMC()
+	pub, _ := newKey(t, 1)
+	k := hashElements(h, pub.A.X, pub.A.Y)
+	var want big.Int
+	k.BigInt(&want)
+	want.Mod(&want, new(big.Int).Lsh(big.NewInt(1), StateDepth))
+	got := KeyIndex(pub, h)
+	if new(big.Int).SetBytes(got[:]).Cmp(&want) != 0 {
+		t.Fatalf("index %s is not the low StateDepth bits of %s", got, k.String())
+	}
+	if KeyIndex(pub, h) != got {
+		t.Fatal("key index is not deterministic")
+	}
+	other, _ := newKey(t, 2)
+	if KeyIndex(other, h) == got {
+		t.Fatal("distinct keys share an index")
+	}
+}
@@ -0,0 +1,209 @@
+package rollup
+
+import (
+	"errors"
+	"hash"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/math/emulated"
+	stdgroth16 "github.com/consensys/gnark/std/recursion/groth16"
+)
+
+// Errors returned while building or assigning an aggregation circuit.
+var (
+	ErrAggregateSize  = errors.New("rollup: aggregate must cover at least one batch proof")
+	ErrAggregateInner = errors.New("rollup: inner circuit does not expose the six batch public inputs")
+	ErrAggregateOrder = errors.New("rollup: aggregated batch numbers are not consecutive")
+)
+
+// Aliases for the emulated BN254 types the in-circuit Groth16 verifier works
+// over.
+type (
+	innerProof   = stdgroth16.Proof[sw_bn254.G1Affine, sw_bn254.G2Affine]
+	innerWitness = stdgroth16.Witness[sw_bn254.ScalarField]
+	innerVK      = stdgroth16.VerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl]
+)
+
+// AggregateCircuit folds a span of consecutive batch proofs into one proof. It
+// verifies every inner Groth16 proof in-circuit against the batch circuit's
+// verifying key, which is fixed when the aggregate is built, and checks that
+// the roots chain, the NewRoot of proof i being the OldRoot of proof i+1, and
+// that the batch numbers count up by one.
+//
+// The aggregate exposes the span's first OldRoot, its last NewRoot and
+// BatchHash, which commits to every batch's deposit, withdrawal and data
+// hashes and batch number (see AggregateBatchHash) under the batch circuit's
+// hash suite. Inner proofs must come from a circuit built without
+// WithPublicCommitment and be produced with prove.ProveRecursive; the
+// aggregate itself is proven with prove.Prove.
+type AggregateCircuit struct {
+	OldRoot   frontend.Variable `gnark:",public"`
+	NewRoot   frontend.Variable `gnark:",public"`
+	BatchHash frontend.Variable `gnark:",public"`
+
+	Proofs  []innerProof
+	Batches []innerWitness
+
+	vk   innerVK
+	hash HashSuite
+}
+
+// NewAggregate returns an aggregation circuit over n proofs of the compiled
+// batch circuit inner, whose verifying key is vk. opts are the options inner
+// was built with; only its hash suite matters here.
+func NewAggregate(inner constraint.ConstraintSystem, vk groth16.VerifyingKey, n int, opts ...Option) (*AggregateCircuit, error) {
+	if n < 1 {
+		return nil, ErrAggregateSize
+	}
+	if inner.GetNbPublicVariables() != 1+len(PublicData{}.values()) {
+		return nil, ErrAggregateInner
+	}
+	fixed, err := stdgroth16.ValueOfVerifyingKeyFixed[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](vk)
+	if err != nil {
+		return nil, err
+	}
+	c := &AggregateCircuit{
+		Proofs:  make([]innerProof, n),
+		Batches: make([]innerWitness, n),
+		vk:      fixed,
+		hash:    options(opts).hash,
+	}
+	for i := range c.Proofs {
+		c.Proofs[i] = stdgroth16.PlaceholderProof[sw_bn254.G1Affine, sw_bn254.G2Affine](inner)
+		c.Batches[i] = stdgroth16.PlaceholderWitness[sw_bn254.ScalarField](inner)
+	}
+	return c, nil
+}
+
+// Define declares the aggregation constraints.
+func (c *AggregateCircuit) Define(api frontend.API) error {
+	if len(c.Proofs) < 1 || len(c.Proofs) != len(c.Batches) {
+		return ErrAggregateSize
+	}
+	verifier, err := stdgroth16.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return err
+	}
+	f, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return err
+	}
+	h, err := c.hash.circuitHasher(api)
+	if err != nil {
+		return err
+	}
+
+	var batchHash, number frontend.Variable = 0, 0
+	root := c.OldRoot
+	for i := range c.Proofs {
+		if err := verifier.AssertProof(c.vk, c.Proofs[i], c.Batches[i]); err != nil {
+			return err
+		}
+		// the inner and outer scalar fields are the same, so a canonical
+		// emulated public input recombines into the native value
+		public := make([]frontend.Variable, len(c.Batches[i].Public))
+		for k := range public {
+			public[k] = api.FromBinary(f.ToBitsCanonical(&c.Batches[i].Public[k])...)
+		}
+		api.AssertIsEqual(public[0], root)
+		root = public[1]
+		if i > 0 {
+			api.AssertIsEqual(public[5], api.Add(number, 1))
+		}
+		number = public[5]
+
+		h.Reset()
+		h.Write(batchHash)
+		h.Write(public[2:]...)
+		batchHash = h.Sum()
+	}
+	api.AssertIsEqual(root, c.NewRoot)
+	api.AssertIsEqual(batchHash, c.BatchHash)
+	return nil
+}
+
+// AssignAggregate returns the assignment of an aggregation circuit over the
+// given inner proofs and their public witnesses, in batch order, for an
+// aggregate built with the same opts. It fails with ErrAggregateOrder if the
+// batch numbers are not consecutive.
+func AssignAggregate(proofs []groth16.Proof, publics []witness.Witness, opts ...Option) (*AggregateCircuit, error) {
+	c, batches, err := assignAggregate(proofs, publics, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(batches); i++ {
+		if batches[i].BatchNumber != batches[i-1].BatchNumber+1 {
+			return nil, ErrAggregateOrder
+		}
+	}
+	return c, nil
+}
+
+// assignAggregate is AssignAggregate without the order check, and also returns
+// the batches' public data.
+func assignAggregate(proofs []groth16.Proof, publics []witness.Witness, opts []Option) (*AggregateCircuit, []PublicData, error) {
+	if len(proofs) < 1 || len(proofs) != len(publics) {
+		return nil, nil, ErrAggregateSize
+	}
+	c := &AggregateCircuit{
+		Proofs:  make([]innerProof, len(proofs)),
+		Batches: make([]innerWitness, len(proofs)),
+	}
+	batches := make([]PublicData, len(proofs))
+	for i := range proofs {
+		var err error
+		if c.Proofs[i], err = stdgroth16.ValueOfProof[sw_bn254.G1Affine, sw_bn254.G2Affine](proofs[i]); err != nil {
+			return nil, nil, err
+		}
+		if c.Batches[i], err = stdgroth16.ValueOfWitness[sw_bn254.ScalarField](publics[i]); err != nil {
+			return nil, nil, err
+		}
+		if batches[i], err = publicData(publics[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.OldRoot = batches[0].OldRoot
+	c.NewRoot = batches[len(batches)-1].NewRoot
+	c.BatchHash = AggregateBatchHash(batches, options(opts).hash.New())
+	return c, batches, nil
+}
+
+// AggregateBatchHash chains the per-batch hashes and numbers of a span of
+// batches, in batch order, into the commitment exposed by
+// AggregateCircuit.BatchHash:
+//
+//	c_0 = 0, c_k = H(c_{k-1} || depositHash_k || withdrawalHash_k || dataHash_k || batchNumber_k)
+//
+// The hasher is reset before use.
+func AggregateBatchHash(batches []PublicData, h hash.Hash) []byte {
+	var acc fr.Element
+	for _, p := range batches {
+		var d, w, t, n fr.Element
+		d.SetBytes(p.DepositHash)
+		w.SetBytes(p.WithdrawalHash)
+		t.SetBytes(p.DataHash)
+		n.SetUint64(p.BatchNumber)
+		acc = hashElements(h, acc, d, w, t, n)
+	}
+	b := acc.Bytes()
+	return b[:]
+}
+
+// publicData reads a batch proof's public witness back into its PublicData.
+func publicData(public witness.Witness) (PublicData, error) {
+	v, ok := public.Vector().(fr.Vector)
+	if !ok || len(v) != len(PublicData{}.values()) || !v[5].IsUint64() {
+		return PublicData{}, ErrAggregateInner
+	}
+	out := make([][]byte, len(v))
+	for i := range v {
+		b := v[i].Bytes()
+		out[i] = b[:]
+	}
+	return PublicData{OldRoot: out[0], NewRoot: out[1], DepositHash: out[2], WithdrawalHash: out[3], DataHash: out[4], BatchNumber: v[5].Uint64()}, nil
+}
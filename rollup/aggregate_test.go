@@ -0,0 +1,167 @@
+package rollup
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
+)
+
+// proveSpan proves three chained single-transfer batches, numbered 1, 2 and
+// 4, with the recursion helpers. It returns a constructor for the aggregation
+// circuit over n batches (the test engine consumes the circuit it solves) with
+// the proofs and their public witnesses.
+func proveSpan(t *testing.T) (func(n int) *AggregateCircuit, []groth16.Proof, []witness.Witness) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16)
+	var batches [][]TransferWitness
+	for _, n := range []uint64{1, 2, 4} {
+		op.SetBatchNumber(n)
+		batches = append(batches, applyTransfers(t, op, privs, 1))
+	}
+	pathLen := len(batches[0][0].SenderProof.Path)
+
+	ccs, err := prove.Compile(New(1, pathLen))
+	if err != nil {
+		t.Fatalf("compile batch circuit: %v", err)
+	}
+	keys, err := prove.Setup(ccs)
+	if err != nil {
+		t.Fatalf("setup batch circuit: %v", err)
+	}
+	proofs := make([]groth16.Proof, len(batches))
+	publics := make([]witness.Witness, len(batches))
+	for i, witnesses := range batches {
+		if proofs[i], publics[i], err = prove.ProveRecursive(ccs, keys.PK, Assign(witnesses, pathLen)); err != nil {
+			t.Fatalf("prove batch %d: %v", i, err)
+		}
+		if err := prove.VerifyRecursive(proofs[i], keys.VK, publics[i]); err != nil {
+			t.Fatalf("verify batch %d: %v", i, err)
+		}
+	}
+
+	newCircuit := func(n int) *AggregateCircuit {
+		circuit, err := NewAggregate(ccs, keys.VK, n)
+		if err != nil {
+			t.Fatalf("new aggregate: %v", err)
+		}
+		return circuit
+	}
+	return newCircuit, proofs, publics
+}
+
+func TestAggregateSolvesChainedBatches(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping recursive aggregation in -short mode")
+	}
+	newCircuit, proofs, publics := proveSpan(t)
+	assignment, err := AssignAggregate(proofs[:2], publics[:2])
+	if err != nil {
+		t.Fatalf("assign aggregate: %v", err)
+	}
+	if err := test.IsSolved(newCircuit(2), assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("aggregate should accept two chained batch proofs: %v", err)
+	}
+
+	// the same two proofs in the wrong order do not chain
+	swappedProofs, swappedPublics := []groth16.Proof{proofs[1], proofs[0]}, []witness.Witness{publics[1], publics[0]}
+	if _, err := AssignAggregate(swappedProofs, swappedPublics); err != ErrAggregateOrder {
+		t.Fatalf("expected ErrAggregateOrder for swapped batches, got %v", err)
+	}
+	swapped, _, err := assignAggregate(swappedProofs, swappedPublics, nil)
+	if err != nil {
+		t.Fatalf("assign swapped aggregate: %v", err)
+	}
+	if err := test.IsSolved(newCircuit(2), swapped, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("aggregate accepted batch proofs whose roots do not chain")
+	}
+
+	// batches 2 and 4 chain by root, but batch 3 is missing
+	if _, err := AssignAggregate(proofs[1:], publics[1:]); err != ErrAggregateOrder {
+		t.Fatalf("expected ErrAggregateOrder for a gap, got %v", err)
+	}
+	gap, _, err := assignAggregate(proofs[1:], publics[1:], nil)
+	if err != nil {
+		t.Fatalf("assign aggregate with a gap: %v", err)
+	}
+	if err := test.IsSolved(newCircuit(2), gap, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("aggregate accepted batch numbers that are not consecutive")
+	}
+}
+
+func TestAggregateProveVerify(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping recursive aggregation in -short mode")
+	}
+	newCircuit, proofs, publics := proveSpan(t)
+	ccs, err := prove.Compile(newCircuit(1))
+	if err != nil {
+		t.Fatalf("compile aggregate: %v", err)
+	}
+	keys, err := prove.Setup(ccs)
+	if err != nil {
+		t.Fatalf("setup aggregate: %v", err)
+	}
+	assignment, err := AssignAggregate(proofs[:1], publics[:1])
+	if err != nil {
+		t.Fatalf("assign aggregate: %v", err)
+	}
+	proof, public, err := prove.Prove(ccs, keys.PK, assignment)
+	if err != nil {
+		t.Fatalf("prove aggregate: %v", err)
+	}
+	if err := prove.Verify(proof, keys.VK, public); err != nil {
+		t.Fatalf("verify aggregate: %v", err)
+	}
+
+	// the aggregate proof is bound to the span's public values
+	other, err := AssignAggregate(proofs[1:2], publics[1:2])
+	if err != nil {
+		t.Fatalf("assign other aggregate: %v", err)
+	}
+	otherPublic, err := frontend.NewWitness(other, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		t.Fatalf("other public witness: %v", err)
+	}
+	if err := prove.Verify(proof, keys.VK, otherPublic); err == nil {
+		t.Fatal("aggregate proof verified against another batch's public values")
+	}
+}
+
+// TestReportAggregateConstraints logs the aggregate's size for one and two
+// inner proofs, whose difference is the cost of each further proof (see
+// decisions/2026-10-16-recursive-aggregation.md).
+func TestReportAggregateConstraints(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping recursive aggregation in -short mode")
+	}
+	newCircuit, _, _ := proveSpan(t)
+	var nbConstraints [3]int
+	for _, n := range []int{1, 2} {
+		ccs, err := prove.Compile(newCircuit(n))
+		if err != nil {
+			t.Fatalf("compile aggregate of %d: %v", n, err)
+		}
+		nbConstraints[n] = ccs.GetNbConstraints()
+		t.Logf("aggregate n=%d: %d R1CS constraints", n, nbConstraints[n])
+	}
+	t.Logf("aggregate: %d R1CS constraints per further inner proof", nbConstraints[2]-nbConstraints[1])
+}
+
+func TestNewAggregateRejectsCommitmentCircuit(t *testing.T) {
+	_, pathLen := buildBatch(t, 16, 1)
+	ccs, err := prove.Compile(New(1, pathLen, WithPublicCommitment()))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if _, err := NewAggregate(ccs, groth16.NewVerifyingKey(prove.Curve), 1); err != ErrAggregateInner {
+		t.Fatalf("expected ErrAggregateInner, got %v", err)
+	}
+	if _, err := AssignAggregate(nil, nil); err != ErrAggregateSize {
+		t.Fatalf("expected ErrAggregateSize for an empty span, got %v", err)
+	}
+}
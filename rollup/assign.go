@@ -1,12 +1,18 @@
 package rollup
 
 import (
+	"errors"
+
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
-	tedwards "github.com/consensys/gnark-crypto/ecc/twistededwards"
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/std/accumulator/merkle"
+	"github.com/consensys/gnark/std/signature/eddsa"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/gadget"
 )
 
+// ErrMixedBatchNumber is the panic value of Assign for witnesses applied in
+// different batches.
+var ErrMixedBatchNumber = errors.New("rollup: witnesses span several batch numbers")
+
 // toElem converts a uint64 into a field element for witness assignment.
 func toElem(v uint64) fr.Element {
 	var e fr.Element
@@ -16,10 +22,26 @@ func toElem(v uint64) fr.Element {
 
 // Assign builds a fully populated Circuit assignment from a batch of applied
 // transfers (as produced by Operator.ApplyTransfer). pathLen must match the
-// Merkle path length of the proofs (tree depth + 1). The returned value is ready
-// to pass to the prover alongside a circuit built with New(len(witnesses), pathLen).
-func Assign(witnesses []TransferWitness, pathLen int) *Circuit {
-	c := New(len(witnesses), pathLen)
+// Merkle path length of the proofs (StateDepth + 1), and opts must be the
+// options the circuit was built with. The returned value is ready to pass to
+// the prover alongside a circuit built with New(len(witnesses), pathLen, opts...).
+// The witnesses must be consecutive (each RootBefore equal to the previous
+// RootAfter), as produced by applying the batch in order on one operator; the
+// public OldRoot/NewRoot are taken from the first and last witness. They must
+// all be applied in one batch: Assign panics with ErrMixedBatchNumber if their
+// BatchNumbers differ.
+func Assign(witnesses []TransferWitness, pathLen int, opts ...Option) *Circuit {
+	for _, w := range witnesses {
+		if w.BatchNumber != witnesses[0].BatchNumber {
+			panic(ErrMixedBatchNumber)
+		}
+	}
+	c := New(len(witnesses), pathLen, opts...)
+	p := BatchPublicData(witnesses, opts...)
+	c.OldRoot, c.NewRoot = p.OldRoot, p.NewRoot
+	c.DepositHash, c.WithdrawalHash, c.DataHash = p.DepositHash, p.WithdrawalHash, p.DataHash
+	c.BatchNumber = p.BatchNumber
+	c.PublicInputs = PublicAssignment(p, opts...).PublicInputs
 
 	for i := range witnesses {
 		w := witnesses[i]
@@ -32,31 +54,85 @@ func Assign(witnesses []TransferWitness, pathLen int) *Circuit {
 		assignAccount(&c.ReceiverBefore[i], w.ReceiverBefore)
 		assignAccount(&c.ReceiverAfter[i], w.ReceiverAfter)
 
-		assignProof(&c.ProofSenderBefore[i], w.SenderProofBefore)
-		assignProof(&c.ProofSenderAfter[i], w.SenderProofAfter)
-		assignProof(&c.ProofReceiverBefore[i], w.ReceiverProofBefore)
-		assignProof(&c.ProofReceiverAfter[i], w.ReceiverProofAfter)
+		assignPath(&c.PathSender[i], w.SenderProof)
+		assignPath(&c.PathReceiver[i], w.ReceiverProof)
 
+		c.Transfers[i].Type = uint64(w.Type)
+		c.Transfers[i].TokenID = w.TokenID
 		c.Transfers[i].Amount = w.Amount
+		c.Transfers[i].Fee = w.Fee
+		c.Transfers[i].ValidUntil = w.ValidUntil
 		c.Transfers[i].Nonce = toElem(w.SenderBefore.Nonce)
-		c.Transfers[i].Sender.Assign(tedwards.BN254, w.SenderPubKeyRaw)
-		c.Transfers[i].Receiver.Assign(tedwards.BN254, w.ReceiverPubKeyRaw)
-		c.Transfers[i].Signature.Assign(tedwards.BN254, w.SignatureRaw)
+		c.Transfers[i].Recipient = w.Recipient[:]
+		assignPubKey(&c.Transfers[i].Sender, w.SenderBefore)
+		assignPubKey(&c.Transfers[i].Receiver, w.ReceiverAfter)
+		var sig []byte // no signature: the scheme's placeholder
+		if w.Type.signed() {
+			sig = w.SignatureRaw
+		}
+		c.auth.Assign(c.Transfers[i].Signature, sig)
 	}
 	return c
 }
 
+// PublicAssignment returns a Circuit with only PublicInputs assigned, for a
+// circuit built with opts, from the batch's public data. A verifier uses it to
+// build the public witness (frontend.NewWitness with frontend.PublicOnly).
+func PublicAssignment(p PublicData, opts ...Option) *Circuit {
+	c := options(opts)
+	if c.commitment {
+		c.PublicInputs = []frontend.Variable{PublicCommitment(p)}
+		return c
+	}
+	for _, v := range p.values() {
+		c.PublicInputs = append(c.PublicInputs, v)
+	}
+	return c
+}
+
+// batchDeposits returns the deposits credited by a batch, in slot order.
+func batchDeposits(witnesses []TransferWitness) []Deposit {
+	var ds []Deposit
+	for _, w := range witnesses {
+		if w.Type == TxDeposit {
+			ds = append(ds, Deposit{PubKey: w.ReceiverAfter.PubKey, TokenID: w.TokenID, Amount: w.Amount})
+		}
+	}
+	return ds
+}
+
+// batchExits returns the exits proved by a batch's withdrawals, in slot order.
+func batchExits(witnesses []TransferWitness) []Exit {
+	var es []Exit
+	for _, w := range witnesses {
+		if w.Type == TxWithdrawal {
+			es = append(es, Exit{Recipient: w.Recipient, TokenID: w.TokenID, Amount: w.Amount})
+		}
+	}
+	return es
+}
+
+// assignPubKey assigns acc's public key coordinates directly rather than from
+// the compressed encoding, so accounts whose key is not a curve point (empty
+// slots) can still be assigned.
+func assignPubKey(dst *eddsa.PublicKey, acc Account) {
+	dst.A.X = acc.PubKey.A.X
+	dst.A.Y = acc.PubKey.A.Y
+}
+
 func assignAccount(dst *AccountConstraints, acc Account) {
-	dst.Index = toElem(acc.Index)
+	dst.Index = acc.Index.element()
 	dst.Nonce = toElem(acc.Nonce)
-	dst.Balance = acc.Balance
-	dst.PubKey.Assign(tedwards.BN254, acc.PubKey.Bytes())
+	for j := range acc.Balances {
+		dst.Balances[j] = acc.Balances[j]
+	}
+	assignPubKey(&dst.PubKey, acc)
 }
 
-func assignProof(dst *merkle.MerkleProof, p MerkleProofData) {
-	dst.RootHash = p.RootHash
-	dst.Path = make([]frontend.Variable, len(p.Path))
-	for j := range p.Path {
-		dst.Path[j] = p.Path[j]
+// assignPath assigns the siblings of p, dropping its leaf (Path[0]).
+func assignPath(dst *gadget.MerklePath, p MerkleProofData) {
+	dst.Siblings = make([]frontend.Variable, len(p.Path)-1)
+	for j := range dst.Siblings {
+		dst.Siblings[j] = p.Path[j+1]
 	}
 }
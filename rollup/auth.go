@@ -0,0 +1,232 @@
+package rollup
+
+import (
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	cedwards "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	tedwards "github.com/consensys/gnark-crypto/ecc/twistededwards"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/native/twistededwards"
+	ghash "github.com/consensys/gnark/std/hash"
+	"github.com/consensys/gnark/std/math/cmp"
+	geddsa "github.com/consensys/gnark/std/signature/eddsa"
+)
+
+// ErrSignatureSize is returned when an in-circuit signature does not have the
+// Authorizer's SigLen elements.
+var ErrSignatureSize = errors.New("rollup: in-circuit signature does not match the authorizer")
+
+// Authorizer is how a rollup instance authorizes transfers and withdrawals: how
+// their owners sign the transaction message natively and how the circuit
+// checks that signature. Implementations use the account keys as they are,
+// points of the twisted Edwards curve embedded in BN254 (eddsa.PublicKey), and
+// hash with the rollup's HashSuite. The operator, the signers and the circuit
+// must all use the same Authorizer: the operator and the circuit through
+// WithAuthorizer, the signers through Transfer.SignWith and
+// Withdrawal.SignWith.
+type Authorizer interface {
+	// Name identifies the scheme; a Store pins it.
+	Name() string
+	// Sign signs msg with priv and returns the raw signature. h must be a
+	// hasher of the rollup's HashSuite.
+	Sign(priv eddsa.PrivateKey, msg []byte, h hash.Hash) ([]byte, error)
+	// Verify reports whether sig is a valid signature of msg by pub. It
+	// fails on a signature that is not encoded for the scheme.
+	Verify(pub eddsa.PublicKey, sig, msg []byte, h hash.Hash) (bool, error)
+
+	// SigLen returns the number of field elements of an in-circuit signature.
+	SigLen() int
+	// Assign assigns the in-circuit signature dst from a raw signature, or
+	// from an unsigned slot's placeholder when sig is nil. The placeholder
+	// must keep IsValid well defined; its result is ignored.
+	Assign(dst []frontend.Variable, sig []byte)
+	// IsValid returns 1 if sig is a valid signature of msg by pub and 0
+	// otherwise. It may also fail the proof on a malformed signature, so
+	// unsigned slots are checked against the placeholder that Assign
+	// produces.
+	IsValid(api frontend.API, curve twistededwards.Curve, h ghash.FieldHasher, pub twistededwards.Point, sig []frontend.Variable, msg frontend.Variable) (frontend.Variable, error)
+}
+
+// EdDSA is the default Authorizer: gnark-crypto's EdDSA, a signature (R, S)
+// checked as [S]G = R + [H(R, A, msg)]A up to the cofactor.
+type EdDSA struct{}
+
+// Schnorr is an Authorizer with Schnorr signatures (e, s), where
+// e = H(tag, R, A, msg) for R = [s]G - [e]A. Its signature is one field element
+// shorter than EdDSA's and it costs slightly fewer constraints: the circuit
+// recomputes R instead of taking it as a witness and skips the cofactor check.
+type Schnorr struct{}
+
+// schnorrTag separates the Schnorr challenge H(tag, R, A, msg) from the EdDSA
+// one H(R, A, msg), so a signature under one scheme never converts into one
+// under the other for the same key. It is "schnorr" in ASCII.
+const schnorrTag uint64 = 0x7363686e6f7272
+
+// Name returns "EdDSA".
+func (EdDSA) Name() string { return "EdDSA" }
+
+// Sign signs msg with priv.
+func (EdDSA) Sign(priv eddsa.PrivateKey, msg []byte, h hash.Hash) ([]byte, error) {
+	return priv.Sign(msg, h)
+}
+
+// Verify reports whether sig is a valid EdDSA signature of msg by pub.
+func (EdDSA) Verify(pub eddsa.PublicKey, sig, msg []byte, h hash.Hash) (bool, error) {
+	return pub.Verify(sig, msg, h)
+}
+
+// SigLen returns 3: R.X, R.Y and S.
+func (EdDSA) SigLen() int { return 3 }
+
+// Assign assigns R and S from sig, or the identity point R and a zero S for an
+// unsigned slot.
+func (EdDSA) Assign(dst []frontend.Variable, sig []byte) {
+	if sig == nil {
+		dst[0], dst[1], dst[2] = 0, 1, 0
+		return
+	}
+	var s geddsa.Signature
+	s.Assign(tedwards.BN254, sig)
+	dst[0], dst[1], dst[2] = s.R.X, s.R.Y, s.S
+}
+
+// IsValid checks sig with gnark's in-circuit EdDSA verifier.
+func (a EdDSA) IsValid(api frontend.API, curve twistededwards.Curve, h ghash.FieldHasher, pub twistededwards.Point, sig []frontend.Variable, msg frontend.Variable) (frontend.Variable, error) {
+	if len(sig) != a.SigLen() {
+		return 0, ErrSignatureSize
+	}
+	// eddsa.IsValid hashes H(R,A,msg) without resetting first, so the hasher must
+	// be in its initial state here. Sum keeps the chaining value, so an explicit
+	// Reset is required.
+	h.Reset()
+	return geddsa.IsValid(curve, geddsa.Signature{R: twistededwards.Point{X: sig[0], Y: sig[1]}, S: sig[2]}, msg, geddsa.PublicKey{A: pub}, h)
+}
+
+// Name returns "Schnorr".
+func (Schnorr) Name() string { return "Schnorr" }
+
+// Sign signs msg with priv, see schnorrSign.
+func (Schnorr) Sign(priv eddsa.PrivateKey, msg []byte, h hash.Hash) ([]byte, error) {
+	return schnorrSign(priv, msg, h)
+}
+
+// Verify reports whether sig is a valid Schnorr signature of msg by pub.
+func (Schnorr) Verify(pub eddsa.PublicKey, sig, msg []byte, h hash.Hash) (bool, error) {
+	return schnorrVerify(pub, sig, msg, h)
+}
+
+// SigLen returns 2: e and s.
+func (Schnorr) SigLen() int { return 2 }
+
+// Assign assigns e and s from sig, or zeros for an unsigned slot.
+func (Schnorr) Assign(dst []frontend.Variable, sig []byte) {
+	if sig == nil {
+		dst[0], dst[1] = 0, 0
+		return
+	}
+	dst[0], dst[1] = sig[:fr.Bytes], sig[fr.Bytes:]
+}
+
+// IsValid recomputes R = [s]G - [e]A and compares its challenge with e. It
+// fails the proof if s is not below the subgroup order.
+func (a Schnorr) IsValid(api frontend.API, curve twistededwards.Curve, h ghash.FieldHasher, pub twistededwards.Point, sig []frontend.Variable, msg frontend.Variable) (frontend.Variable, error) {
+	if len(sig) != a.SigLen() {
+		return 0, ErrSignatureSize
+	}
+	e, z := sig[0], sig[1]
+	base := twistededwards.Point{X: curve.Params().Base[0], Y: curve.Params().Base[1]}
+	api.AssertIsEqual(cmp.IsLess(api, z, curve.Params().Order), 1)
+	r := curve.DoubleBaseScalarMul(base, curve.Neg(pub), z, e)
+	h.Reset()
+	h.Write(schnorrTag, r.X, r.Y, pub.X, pub.Y, msg)
+	return api.IsZero(api.Sub(h.Sum(), e)), nil
+}
+
+// WithAuthorizer selects the Authorizer (default EdDSA) of the circuit and,
+// passed to NewOperator or OpenStore, of the operator. Both must use the same.
+func WithAuthorizer(a Authorizer) Option {
+	return func(c *Circuit) {
+		c.auth = a
+	}
+}
+
+// schnorrSign signs msg with the secret scalar x of priv as e || s, each a
+// 32-byte big-endian integer: e = H(tag, R, A, msg) for R = [k]G, and
+// s = k + e*x mod the subgroup order. The nonce k is derived from the private
+// key and msg, like EdDSA's, but with a scheme tag, so signing a message under
+// both schemes never reuses a nonce.
+func schnorrSign(priv eddsa.PrivateKey, msg []byte, h hash.Hash) ([]byte, error) {
+	curve := cedwards.GetEdwardsCurve()
+	key := priv.Bytes()
+	secret := key[fr.Bytes : 2*fr.Bytes]
+
+	var tag fr.Element
+	tag.SetUint64(schnorrTag)
+	tb := tag.Bytes()
+	d := sha512.New()
+	d.Write(tb[:])
+	d.Write(key[fr.Bytes:])
+	d.Write(msg)
+	var k big.Int
+	k.SetBytes(d.Sum(nil)).Mod(&k, &curve.Order)
+
+	var r cedwards.PointAffine
+	r.ScalarMultiplication(&curve.Base, &k)
+	e, err := schnorrChallenge(h, &r, &priv.PublicKey.A, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var x, z big.Int
+	x.SetBytes(secret)
+	z.Mul(e, &x).Add(&z, &k).Mod(&z, &curve.Order)
+	sig := make([]byte, 2*fr.Bytes)
+	e.FillBytes(sig[:fr.Bytes])
+	z.FillBytes(sig[fr.Bytes:])
+	return sig, nil
+}
+
+// schnorrVerify checks a signature e || s by recomputing R = [s]G - [e]A and
+// comparing its challenge with e. s must be below the subgroup order and e a
+// field element, as the circuit requires.
+func schnorrVerify(pub eddsa.PublicKey, sig, msg []byte, h hash.Hash) (bool, error) {
+	if len(sig) != 2*fr.Bytes {
+		return false, errors.New("rollup: invalid Schnorr signature length")
+	}
+	curve := cedwards.GetEdwardsCurve()
+	var e, z big.Int
+	e.SetBytes(sig[:fr.Bytes])
+	z.SetBytes(sig[fr.Bytes:])
+	if e.Cmp(fr.Modulus()) >= 0 || z.Cmp(&curve.Order) >= 0 {
+		return false, nil
+	}
+
+	var sG, eA, r cedwards.PointAffine
+	sG.ScalarMultiplication(&curve.Base, &z)
+	eA.ScalarMultiplication(&pub.A, &e)
+	r.Add(&sG, eA.Neg(&eA))
+	want, err := schnorrChallenge(h, &r, &pub.A, msg)
+	if err != nil {
+		return false, err
+	}
+	return want.Cmp(&e) == 0, nil
+}
+
+// schnorrChallenge returns H(tag, R.X, R.Y, A.X, A.Y, msg) as an integer.
+func schnorrChallenge(h hash.Hash, r, a *cedwards.PointAffine, msg []byte) (*big.Int, error) {
+	h.Reset()
+	var tag fr.Element
+	tag.SetUint64(schnorrTag)
+	tb, rx, ry, ax, ay := tag.Bytes(), r.X.Bytes(), r.Y.Bytes(), a.X.Bytes(), a.Y.Bytes()
+	for _, b := range [][]byte{tb[:], rx[:], ry[:], ax[:], ay[:], msg} {
+		if _, err := h.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	return new(big.Int).SetBytes(h.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+package rollup
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+)
+
+func TestSchnorrSignature(t *testing.T) {
+	r := rand.New(rand.NewSource(5)) //#nosec G404 -- deterministic test
+	acc, priv, err := NewAccount(0, r)
+	if err != nil {
+		t.Fatalf("account: %v", err)
+	}
+	var schnorr, ed Authorizer = Schnorr{}, EdDSA{}
+	m, o := toElem(42), toElem(43)
+	msg, other := m.Bytes(), o.Bytes()
+	sig, err := schnorr.Sign(priv, msg[:], cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, err := schnorr.Verify(acc.PubKey, sig, msg[:], cmimc.NewMiMC()); err != nil || !ok {
+		t.Fatalf("expected the signature to verify: %v", err)
+	}
+	if ok, _ := schnorr.Verify(acc.PubKey, sig, other[:], cmimc.NewMiMC()); ok {
+		t.Fatal("the signature verified for another message")
+	}
+	if ok, _ := ed.Verify(acc.PubKey, sig, msg[:], cmimc.NewMiMC()); ok {
+		t.Fatal("a Schnorr signature verified as EdDSA")
+	}
+	edSig, err := ed.Sign(priv, msg[:], cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, _ := schnorr.Verify(acc.PubKey, edSig, msg[:], cmimc.NewMiMC()); ok {
+		t.Fatal("an EdDSA signature verified as Schnorr")
+	}
+}
+
+// buildSchnorrBatch applies a transfer, a withdrawal and a deposit on an
+// operator authorizing with Schnorr signatures.
+func buildSchnorrBatch(t *testing.T) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 8, WithAuthorizer(Schnorr{}))
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+
+	transfer := NewTransfer(4, sender.PubKey, receiver.PubKey, sender.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(transfer); !errors.Is(err, ErrWrongSignature) {
+		t.Fatalf("expected ErrWrongSignature for an EdDSA transfer, got %v", err)
+	}
+	if _, err := transfer.SignWith(Schnorr{}, privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	wd := NewWithdrawal(3, receiver.PubKey, testRecipient, receiver.Nonce)
+	if _, err := wd.SignWith(Schnorr{}, privs[1], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ww, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	dw, err := op.ApplyDeposit(NewDeposit(7, sender.PubKey))
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	return []TransferWitness{tw, ww, dw}, len(tw.SenderProof.Path)
+}
+
+func TestCircuitSchnorr(t *testing.T) {
+	cases := []solveCase{{name: "valid", ok: true}}
+	for i := 0; i < 2; i++ {
+		cases = append(cases, solveCase{
+			name: fmt.Sprintf("forged signature in slot %d", i),
+			assignment: func(a *Circuit, _ []TransferWitness) {
+				a.Transfers[i].Signature[1] = 1
+			},
+		})
+	}
+	runSolveCases(t, buildSchnorrBatch, cases, WithAuthorizer(Schnorr{}))
+}
@@ -0,0 +1,105 @@
+package rollup
+
+import (
+	"fmt"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// BatchError reports which transfer of a batch failed to apply, and why. The
+// operator state is left as it was before the batch.
+type BatchError struct {
+	Index int   // position of the failing transfer in the batch
+	Err   error // error ApplyTransfer returned for it
+}
+
+// Error implements error.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("rollup: batch transfer %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the transfer's error, so errors.Is sees through a BatchError.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyBatch applies transfers in order, atomically: it returns one
+// TransferWitness per transfer when all of them apply, and otherwise a
+// *BatchError naming the first failing transfer, with the state (accounts,
+// leaves, root, key index and pending fees) exactly as before the call.
+func (o *Operator) ApplyBatch(transfers []Transfer) ([]TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.begin()
+	witnesses := make([]TransferWitness, 0, len(transfers))
+	for i := range transfers {
+		w, err := o.applyTransfer(transfers[i])
+		if err != nil {
+			o.rollback()
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		witnesses = append(witnesses, w)
+	}
+	o.commit()
+	return witnesses, nil
+}
+
+// undoLog records the state a batch overwrites, so it can be restored.
+type undoLog struct {
+	accounts    []Account // previous content of each written slot, in write order
+	keys        []keyEntry
+	pendingFees fr.Element
+}
+
+// keyEntry is a previous accountMap entry.
+type keyEntry struct {
+	key     string
+	index   Index
+	present bool
+}
+
+// begin starts recording the changes to roll back.
+func (o *Operator) begin() {
+	o.undo = &undoLog{pendingFees: o.pendingFees}
+}
+
+// commit keeps the changes recorded since begin.
+func (o *Operator) commit() {
+	o.undo = nil
+}
+
+// rollback restores the state recorded at begin.
+func (o *Operator) rollback() {
+	u := o.undo
+	o.undo = nil
+	for i := len(u.accounts) - 1; i >= 0; i-- {
+		o.writeAccount(u.accounts[i])
+	}
+	for i := len(u.keys) - 1; i >= 0; i-- {
+		if e := u.keys[i]; e.present {
+			o.accountMap[e.key] = e.index
+		} else {
+			delete(o.accountMap, e.key)
+		}
+	}
+	o.pendingFees = u.pendingFees
+}
+
+// recordAccount saves the current content of slot i if a batch is recording.
+func (o *Operator) recordAccount(i Index) {
+	if o.undo == nil {
+		return
+	}
+	o.undo.accounts = append(o.undo.accounts, o.readAccount(i))
+}
+
+// indexKey maps pub to the account index i in accountMap.
+func (o *Operator) indexKey(pub eddsa.PublicKey, i Index) {
+	key := accountKey(pub)
+	if o.undo != nil {
+		prev, ok := o.accountMap[key]
+		o.undo.keys = append(o.undo.keys, keyEntry{key: key, index: prev, present: ok})
+	}
+	o.accountMap[key] = i
+}
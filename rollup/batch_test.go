@@ -0,0 +1,75 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	"github.com/consensys/gnark/test"
+)
+
+// signedTransfers returns count signed transfers of 1 (fee 1) from account 0
+// to account 1, with consecutive nonces starting at the sender's.
+func signedTransfers(t *testing.T, op *Operator, privs []eddsa.PrivateKey, count int) []Transfer {
+	t.Helper()
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	transfers := make([]Transfer, count)
+	for k := range transfers {
+		transfers[k] = NewTransferWithFee(1, 1, sender.PubKey, receiver.PubKey, sender.Nonce+uint64(k))
+		if _, err := transfers[k].Sign(privs[0], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign %d: %v", k, err)
+		}
+	}
+	return transfers
+}
+
+func TestApplyBatchRollsBack(t *testing.T) {
+	op, privs := newBatchOperator(t, 16)
+	accounts := maps.Clone(op.accounts)
+	root, _ := op.Root()
+
+	transfers := signedTransfers(t, op, privs, 3)
+	transfers[2].Nonce = 7 // signed over the right nonce, so the signature fails
+	_, err := op.ApplyBatch(transfers)
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 2 || !errors.Is(err, ErrWrongSignature) {
+		t.Fatalf("expected a BatchError for transfer 2 wrapping ErrWrongSignature, got %v", err)
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, root) {
+		t.Fatal("failed batch changed the root")
+	}
+	if !maps.Equal(op.accounts, accounts) {
+		t.Fatal("failed batch changed the accounts")
+	}
+	if !op.pendingFees.IsZero() {
+		t.Fatal("failed batch left pending fees")
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	op, privs := newBatchOperator(t, 16)
+	witnesses, err := op.ApplyBatch(signedTransfers(t, op, privs, 3))
+	if err != nil {
+		t.Fatalf("apply batch: %v", err)
+	}
+	if len(witnesses) != 3 {
+		t.Fatalf("got %d witnesses, want 3", len(witnesses))
+	}
+	if sender := accountOf(t, op, privs[0]); sender.Nonce != 3 {
+		t.Fatalf("sender nonce %d, want 3", sender.Nonce)
+	}
+	witnesses, err = op.PadBatch(witnesses, 4)
+	if err != nil {
+		t.Fatalf("pad: %v", err)
+	}
+	pathLen := len(witnesses[0].SenderProof.Path)
+	if err := test.IsSolved(New(len(witnesses), pathLen), Assign(witnesses, pathLen), ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("circuit should accept the applied batch: %v", err)
+	}
+}
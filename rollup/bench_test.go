@@ -1,8 +1,14 @@
 package rollup
 
 import (
+	"math/rand"
 	"testing"
 
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/mimc"
+
+	"github.com/nodebreaker0-0/gnark-rollup-exp/gadget"
 	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
 )
 
@@ -16,6 +22,99 @@ func TestReportConstraints(t *testing.T) {
 			t.Fatalf("compile batch %d: %v", batch, err)
 		}
 		t.Logf("rollup batch=%d: %d R1CS constraints (%d public)", batch, ccs.GetNbConstraints(), ccs.GetNbPublicVariables())
+
+		// the constant "one" wire plus OldRoot, NewRoot, DepositHash,
+		// WithdrawalHash, DataHash and BatchNumber, whatever the batch size
+		if got := ccs.GetNbPublicVariables(); got != 7 {
+			t.Fatalf("batch %d: %d public variables, want 7", batch, got)
+		}
+	}
+
+	witnesses, pathLen := buildBatch(t, 16, 1)
+	ccs, err := prove.Compile(New(len(witnesses), pathLen, WithPublicCommitment()))
+	if err != nil {
+		t.Fatalf("compile with public commitment: %v", err)
+	}
+	t.Logf("rollup batch=1 with public commitment: %d R1CS constraints (%d public)", ccs.GetNbConstraints(), ccs.GetNbPublicVariables())
+	if got := ccs.GetNbPublicVariables(); got != 2 {
+		t.Fatalf("public commitment: %d public variables, want 2", got)
+	}
+
+	nbConstraints := make(map[HashSuite]int)
+	for _, s := range []HashSuite{MiMC, Poseidon2} {
+		ccs, err := prove.Compile(New(len(witnesses), pathLen, WithHashSuite(s)))
+		if err != nil {
+			t.Fatalf("compile with %s: %v", s, err)
+		}
+		nbConstraints[s] = ccs.GetNbConstraints()
+		t.Logf("rollup batch=1 with %s: %d R1CS constraints", s, nbConstraints[s])
+	}
+	if nbConstraints[Poseidon2] >= nbConstraints[MiMC] {
+		t.Fatalf("Poseidon2 circuit (%d constraints) should be smaller than MiMC (%d)", nbConstraints[Poseidon2], nbConstraints[MiMC])
+	}
+}
+
+// pathCircuit is one gadget.MerklePath update, the unit of the rollup
+// circuit's Merkle hashing.
+type pathCircuit struct {
+	Index, OldLeaf, NewLeaf frontend.Variable
+	Path                    gadget.MerklePath
+	OldRoot, NewRoot        frontend.Variable `gnark:",public"`
+}
+
+func (c *pathCircuit) Define(api frontend.API) error {
+	h, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	oldRoot, newRoot := c.Path.Roots(api, &h, c.Index, c.OldLeaf, c.NewLeaf)
+	api.AssertIsEqual(oldRoot, c.OldRoot)
+	api.AssertIsEqual(newRoot, c.NewRoot)
+	return nil
+}
+
+// compressCircuit chains N gadget.Compress calls.
+type compressCircuit struct {
+	Left, Right frontend.Variable
+	Root        frontend.Variable `gnark:",public"`
+	N           int               `gnark:"-"`
+}
+
+func (c *compressCircuit) Define(api frontend.API) error {
+	h, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	node := c.Left
+	for i := 0; i < c.N; i++ {
+		node = gadget.Compress(&h, node, c.Right)
+	}
+	api.AssertIsEqual(node, c.Root)
+	return nil
+}
+
+// TestMerkleCostPerLevel checks that each tree node costs one permutation of
+// the hash: a gadget.MerklePath level is two gadget.Compress calls (the old and
+// the new node) plus the selects that order each node's children. A slot holds
+// two path updates, one per written leaf, over StateDepth levels.
+func TestMerkleCostPerLevel(t *testing.T) {
+	nbConstraints := func(c frontend.Circuit) int {
+		ccs, err := prove.Compile(c)
+		if err != nil {
+			t.Fatalf("compile: %v", err)
+		}
+		return ccs.GetNbConstraints()
+	}
+	slot := nbConstraints(New(2, StateDepth+1)) - nbConstraints(New(1, StateDepth+1))
+	update := nbConstraints(&pathCircuit{Path: gadget.NewMerklePath(StateDepth)})
+	path := nbConstraints(&pathCircuit{Path: gadget.NewMerklePath(StateDepth + 1)}) - update
+	node := nbConstraints(&compressCircuit{N: 2}) - nbConstraints(&compressCircuit{N: 1})
+	t.Logf("a slot: %d constraints, %d in its two path updates; one tree level: %d per path update, %d per node", slot, 2*update, path, node)
+	if 2*update > slot {
+		t.Fatalf("a slot costs %d constraints, less than its two path updates (%d)", slot, 2*update)
+	}
+	if path < 2*node || path > 2*node+8 {
+		t.Fatalf("a path level costs %d constraints, want two node compressions (%d) and the child selects", path, 2*node)
 	}
 }
 
@@ -61,3 +160,31 @@ func BenchmarkProvePLONK(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkStateUpdate compares the Merkle cost of one slot (a leaf write and
+// the proof that follows it) under the sparse tree and under a from-scratch
+// rebuild of the proof over the accounts, for 2^10 accounts in a tree of depth
+// StateDepth. Run with `go test -run '^$' -bench BenchmarkStateUpdate ./rollup`.
+func BenchmarkStateUpdate(b *testing.B) {
+	r := rand.New(rand.NewSource(1)) //#nosec G404 -- deterministic benchmark
+	op, privs := addAccounts(b, NewOperator(cmimc.NewMiMC()), 1<<10, 1, r)
+	acc := accountOf(b, op, privs[0])
+	var empty Account
+	empty.Reset()
+	emptyLeaf := empty.Hash(op.h)
+
+	b.Run("tree", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			acc.Nonce++
+			op.writeAccount(acc)
+			op.proof(acc.Index)
+		}
+	})
+	b.Run("rebuild", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			acc.Nonce++
+			op.accounts[acc.Index] = acc
+			rebuildProof(op.h, StateDepth, accountLeaves(op), emptyLeaf, acc.Index)
+		}
+	})
+}
@@ -1,11 +1,13 @@
 package rollup
 
 import (
+	"errors"
+
 	tedwards "github.com/consensys/gnark-crypto/ecc/twistededwards"
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/std/accumulator/merkle"
 	"github.com/consensys/gnark/std/algebra/native/twistededwards"
-	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/hash"
+	"github.com/consensys/gnark/std/rangecheck"
 	"github.com/consensys/gnark/std/signature/eddsa"
 	"github.com/nodebreaker0-0/gnark-rollup-exp/gadget"
 )
@@ -14,26 +16,77 @@ import (
 // alias for gadget.Account, the reusable account-commitment building block.
 type AccountConstraints = gadget.Account
 
-// TransferConstraints is the in-circuit representation of a signed transfer.
+// TransferConstraints is the in-circuit representation of one batch slot: a
+// signed transfer, a no-op padding slot (TxNoop), an L1 deposit (TxDeposit,
+// credited to Receiver), a signed withdrawal (TxWithdrawal, paid to the L1
+// address Recipient), an account registration (TxCreate, installing Receiver
+// in an empty leaf) or a fee settlement (TxCollectFees, crediting the fee
+// collector). TokenID selects the token the slot moves; Fee is only charged by
+// transfers and always in FeeToken. ValidUntil is the last batch number a
+// transfer may be applied in. Signature is the sender's signature in the
+// circuit's Authorizer.
 type TransferConstraints struct {
-	Amount    frontend.Variable
-	Nonce     frontend.Variable
-	Sender    eddsa.PublicKey
-	Receiver  eddsa.PublicKey
-	Signature eddsa.Signature
+	Type       frontend.Variable
+	TokenID    frontend.Variable
+	Amount     frontend.Variable
+	Fee        frontend.Variable
+	ValidUntil frontend.Variable
+	Nonce      frontend.Variable
+	Sender     eddsa.PublicKey
+	Receiver   eddsa.PublicKey
+	Recipient  frontend.Variable
+	Signature  []frontend.Variable
 }
 
 // Circuit proves that a batch of transfers was applied to the rollup state
-// correctly. For each transfer it checks: both accounts are committed in the
-// "before" root, both are committed in the "after" root, the transfer signature
-// is valid, and balances/nonces are updated according to the rules.
+// correctly. For each transfer it checks: the sender is committed in the
+// "before" root, writing its new state and then the receiver's (committed in
+// the tree the first write produced) yields the "after" root, the transfer
+// signature is valid, and balances/nonces are updated according to the rules.
+// The per-transfer roots are chained (each transfer starts from the root the
+// previous one ended on), so the batch proves one continuous transition from
+// OldRoot to NewRoot.
+//
+// The batch's public data (see PublicData) is OldRoot, NewRoot, DepositHash,
+// WithdrawalHash, DataHash and BatchNumber. By default PublicInputs exposes
+// those six values; built with
+// WithPublicCommitment it exposes the single PublicCommitment over them, which
+// is cheaper to verify on-chain.
 //
 // Build one with New(batchSize, pathLen) before compiling, and produce an
-// assignment with Assign.
+// assignment with Assign (or PublicAssignment for a verifier).
 type Circuit struct {
-	// public state roots, one pair per transfer in the batch
-	RootsBefore []frontend.Variable `gnark:",public"`
-	RootsAfter  []frontend.Variable `gnark:",public"`
+	// PublicInputs are the proof's only public inputs: OldRoot, NewRoot,
+	// DepositHash, WithdrawalHash, DataHash and BatchNumber in that order, or
+	// their PublicCommitment under WithPublicCommitment.
+	PublicInputs []frontend.Variable `gnark:",public"`
+
+	// state transition: the batch moves the state from OldRoot to NewRoot
+	OldRoot frontend.Variable
+	NewRoot frontend.Variable
+
+	// DepositHash commits to the deposits the batch consumed, in order (see the
+	// native DepositHash), so an L1 bridge can check which queued deposits were
+	// credited.
+	DepositHash frontend.Variable
+
+	// WithdrawalHash commits to the (recipient, amount) exits the batch proved,
+	// in order (see the native WithdrawalHash), so a bridge pays out exactly
+	// those.
+	WithdrawalHash frontend.Variable
+
+	// DataHash commits to the batch's signature-free transaction data (see
+	// the native DataHash and EncodeBatch), so an observer holding the
+	// published data can check it is what the proof covers and replay it.
+	DataHash frontend.Variable
+
+	// BatchNumber is the batch's position in the rollup's sequence; every
+	// transfer in the batch is valid until this batch or a later one.
+	BatchNumber frontend.Variable
+
+	// intermediate state roots, one pair per transfer in the batch
+	RootsBefore []frontend.Variable
+	RootsAfter  []frontend.Variable
 
 	// account snapshots before and after, per transfer
 	SenderBefore   []AccountConstraints
@@ -44,78 +97,350 @@ type Circuit struct {
 	// signed transfers
 	Transfers []TransferConstraints
 
-	// Merkle inclusion proofs (Path[0] is the account-hash leaf)
-	ProofSenderBefore   []merkle.MerkleProof
-	ProofSenderAfter    []merkle.MerkleProof
-	ProofReceiverBefore []merkle.MerkleProof
-	ProofReceiverAfter  []merkle.MerkleProof
+	// Merkle paths, one per written leaf: the sender's in the before-tree and
+	// the receiver's in the tree the sender's write produced
+	PathSender   []gadget.MerklePath
+	PathReceiver []gadget.MerklePath
+
+	batchSize    int
+	pathLen      int
+	feeCollector Index
+	domain       Domain
+	auth         Authorizer
+	commitment   bool
+	hash         HashSuite
+}
+
+// Option configures a Circuit at construction. Options fix compile-time
+// parameters, so the prover and verifier must build the circuit with the same
+// ones.
+type Option func(*Circuit)
+
+// options returns an unsized Circuit carrying only the configuration of opts.
+func options(opts []Option) *Circuit {
+	c := &Circuit{auth: EdDSA{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithFeeCollector makes the account at index the only one TxCollectFees slots
+// may credit (default 0). It must match Operator.SetFeeCollector.
+func WithFeeCollector(index Index) Option {
+	return func(c *Circuit) {
+		c.feeCollector = index
+	}
+}
 
-	batchSize int
-	pathLen   int
+// WithDomain fixes the Domain that signed slots must be signed for (default the
+// zero Domain) and, passed to NewOperator or OpenStore, that the operator
+// accepts. The domain is a compile-time constant: hashed first, it costs no
+// constraints.
+func WithDomain(d Domain) Option {
+	return func(c *Circuit) {
+		c.domain = d
+	}
+}
+
+// WithPublicCommitment replaces the six public inputs with their
+// PublicCommitment, so a verifier (typically an L1 contract) passes a single
+// public input. Hashing the public data in-circuit costs a fixed ~214k
+// constraints per batch, independent of the batch size, so it pays off for
+// on-chain verification rather than for small off-chain batches.
+func WithPublicCommitment() Option {
+	return func(c *Circuit) {
+		c.commitment = true
+	}
 }
 
 // New returns a Circuit sized for batchSize transfers with Merkle paths of
-// pathLen elements (pathLen = tree depth + 1). Use it both to compile the
-// circuit and as the template for assignments.
-func New(batchSize, pathLen int) *Circuit {
+// pathLen elements, which must be StateDepth + 1 (the leaf and one sibling per
+// level). Use it both to compile the circuit and as the template for
+// assignments.
+func New(batchSize, pathLen int, opts ...Option) *Circuit {
 	c := &Circuit{
-		batchSize:           batchSize,
-		pathLen:             pathLen,
-		RootsBefore:         make([]frontend.Variable, batchSize),
-		RootsAfter:          make([]frontend.Variable, batchSize),
-		SenderBefore:        make([]AccountConstraints, batchSize),
-		SenderAfter:         make([]AccountConstraints, batchSize),
-		ReceiverBefore:      make([]AccountConstraints, batchSize),
-		ReceiverAfter:       make([]AccountConstraints, batchSize),
-		Transfers:           make([]TransferConstraints, batchSize),
-		ProofSenderBefore:   make([]merkle.MerkleProof, batchSize),
-		ProofSenderAfter:    make([]merkle.MerkleProof, batchSize),
-		ProofReceiverBefore: make([]merkle.MerkleProof, batchSize),
-		ProofReceiverAfter:  make([]merkle.MerkleProof, batchSize),
+		batchSize:      batchSize,
+		pathLen:        pathLen,
+		RootsBefore:    make([]frontend.Variable, batchSize),
+		RootsAfter:     make([]frontend.Variable, batchSize),
+		SenderBefore:   newAccounts(batchSize),
+		SenderAfter:    newAccounts(batchSize),
+		ReceiverBefore: newAccounts(batchSize),
+		ReceiverAfter:  newAccounts(batchSize),
+		Transfers:      make([]TransferConstraints, batchSize),
+		PathSender:     make([]gadget.MerklePath, batchSize),
+		PathReceiver:   make([]gadget.MerklePath, batchSize),
+		auth:           EdDSA{},
 	}
 	for i := 0; i < batchSize; i++ {
-		c.ProofSenderBefore[i].Path = make([]frontend.Variable, pathLen)
-		c.ProofSenderAfter[i].Path = make([]frontend.Variable, pathLen)
-		c.ProofReceiverBefore[i].Path = make([]frontend.Variable, pathLen)
-		c.ProofReceiverAfter[i].Path = make([]frontend.Variable, pathLen)
+		c.PathSender[i] = gadget.NewMerklePath(pathLen - 1)
+		c.PathReceiver[i] = gadget.NewMerklePath(pathLen - 1)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for i := range c.Transfers {
+		c.Transfers[i].Signature = make([]frontend.Variable, c.auth.SigLen())
 	}
+	c.PublicInputs = make([]frontend.Variable, c.nbPublicInputs())
 	return c
 }
 
+// nbPublicInputs returns the length of PublicInputs.
+func (c *Circuit) nbPublicInputs() int {
+	if c.commitment {
+		return 1
+	}
+	return 6
+}
+
+// newAccounts returns n account templates holding NbTokens balances each.
+func newAccounts(n int) []AccountConstraints {
+	as := make([]AccountConstraints, n)
+	for i := range as {
+		as[i] = gadget.NewAccount(NbTokens)
+	}
+	return as
+}
+
 // Define encodes the rollup constraints.
 func (c *Circuit) Define(api frontend.API) error {
+	if c.batchSize < 1 {
+		return errors.New("rollup: circuit batch size must be at least 1")
+	}
+	if c.pathLen != StateDepth+1 {
+		return errors.New("rollup: circuit Merkle paths must hold StateDepth+1 elements")
+	}
 	curve, err := twistededwards.NewEdCurve(api, tedwards.BN254)
 	if err != nil {
 		return err
 	}
-	h, err := mimc.NewMiMC(api)
+	h, err := c.hash.circuitHasher(api)
 	if err != nil {
 		return err
 	}
+	rc := rangecheck.New(api)
+
+	if err := c.verifyPublicInputs(api); err != nil {
+		return err
+	}
+	chainRoots(api, c.OldRoot, c.NewRoot, c.RootsBefore, c.RootsAfter)
+	rc.Check(c.BatchNumber, 64)
+	var deposits, exits, data frontend.Variable = 0, 0, 0
+	var feesCharged, feesCollected frontend.Variable = 0, 0
 
 	for i := 0; i < c.batchSize; i++ {
-		// 1+2. each account is committed at its index in the before/after roots
-		// (the gadget binds the account commitment to the proof leaf, the proof
-		// to the public root, and checks inclusion).
-		gadget.VerifyMembership(api, &h, c.SenderBefore[i], c.ProofSenderBefore[i], c.RootsBefore[i])
-		gadget.VerifyMembership(api, &h, c.ReceiverBefore[i], c.ProofReceiverBefore[i], c.RootsBefore[i])
-		gadget.VerifyMembership(api, &h, c.SenderAfter[i], c.ProofSenderAfter[i], c.RootsAfter[i])
-		gadget.VerifyMembership(api, &h, c.ReceiverAfter[i], c.ProofReceiverAfter[i], c.RootsAfter[i])
-
-		// 3. the transfer is bound to the sender and signed by them
-		bindTransfer(api, c.Transfers[i], c.SenderBefore[i], c.ReceiverBefore[i])
-		if err := verifySignature(api, curve, &h, c.Transfers[i]); err != nil {
+		// 1+2. the sender's leaf is written, then the receiver's, leading from
+		// the before root to the after root (each write is proven along one
+		// path, which yields the roots on both sides of it); a slot that writes
+		// a single leaf leaves the tree unchanged on its other side
+		kind := decodeType(api, c.Transfers[i].Type)
+		mid, rootAfter := gadget.UpdateAccounts(api, h, c.RootsBefore[i],
+			gadget.AccountUpdate{Before: c.SenderBefore[i], After: c.SenderAfter[i], Path: c.PathSender[i]},
+			gadget.AccountUpdate{Before: c.ReceiverBefore[i], After: c.ReceiverAfter[i], Path: c.PathReceiver[i]})
+		api.AssertIsEqual(rootAfter, c.RootsAfter[i])
+		verifySingleWrite(api, kind, c.RootsBefore[i], mid, c.RootsAfter[i])
+
+		// 3. the transfer is bound to the sender and signed by them; the
+		// sender exists, as the identity key of an empty leaf verifies forged
+		// signatures
+		bindTransfer(api, c.Transfers[i], c.SenderBefore[i], c.ReceiverAfter[i])
+		if err := verifySignature(api, curve, h, c.auth, c.domain, c.Transfers[i], kind); err != nil {
 			return err
 		}
+		assertIsEqualIf(api, kind.signed, isEmpty(api, c.SenderBefore[i]), 0)
 
 		// 4. balances and nonce update correctly
-		verifyUpdate(api, c.SenderBefore[i], c.ReceiverBefore[i], c.SenderAfter[i], c.ReceiverAfter[i], c.Transfers[i].Amount)
+		verifyUpdate(api, rc, kind, c.SenderBefore[i], c.ReceiverBefore[i], c.SenderAfter[i], c.ReceiverAfter[i], c.Transfers[i].TokenID, c.Transfers[i].Amount, c.Transfers[i].Fee)
+		verifyDistinct(api, kind.transfer, c.SenderBefore[i], c.ReceiverBefore[i])
+		verifyValidUntil(api, rc, kind.transfer, c.Transfers[i].ValidUntil, c.BatchNumber)
+		verifyNoop(api, kind.noop, c.Transfers[i].Amount, c.RootsBefore[i], c.RootsAfter[i])
+		verifyCreate(api, kind.create, c.Transfers[i].Amount, c.ReceiverBefore[i])
+		verifyKeyIndex(api, h, kind, c.ReceiverBefore[i], c.ReceiverAfter[i])
+		assertIsEqualIf(api, kind.collectFees, c.ReceiverBefore[i].Index, c.feeCollector.element())
+		assertIsEqualIf(api, kind.collectFees, c.Transfers[i].TokenID, FeeToken)
+		feesCharged = api.Add(feesCharged, api.Mul(kind.transfer, c.Transfers[i].Fee))
+		feesCollected = api.Add(feesCollected, api.Mul(kind.collectFees, c.Transfers[i].Amount))
+
+		// 5. deposits are chained into the public deposit-queue hash
+		h.Reset()
+		h.Write(deposits, c.Transfers[i].Receiver.A.X, c.Transfers[i].Receiver.A.Y, c.Transfers[i].TokenID, c.Transfers[i].Amount)
+		deposits = api.Select(kind.deposit, h.Sum(), deposits)
+
+		// 6. withdrawals are chained into the public exit commitment; the
+		// recipient is an L1 address
+		rc.Check(c.Transfers[i].Recipient, 160)
+		h.Reset()
+		h.Write(exits, c.Transfers[i].Recipient, c.Transfers[i].TokenID, c.Transfers[i].Amount)
+		exits = api.Select(kind.withdrawal, h.Sum(), exits)
+
+		// 7. the slot's signature-free data is chained into the public data hash
+		h.Reset()
+		h.Write(data)
+		h.Write(slotData(api, kind, c.Transfers[i], c.SenderBefore[i], c.ReceiverBefore[i])...)
+		data = h.Sum()
+	}
+	api.AssertIsEqual(deposits, c.DepositHash)
+	api.AssertIsEqual(exits, c.WithdrawalHash)
+	api.AssertIsEqual(data, c.DataHash)
+
+	// 8. the fee collector is paid exactly the fees the batch charged
+	api.AssertIsEqual(feesCharged, feesCollected)
+	return nil
+}
+
+// verifyPublicInputs binds PublicInputs to the batch's public data, directly or
+// through its PublicCommitment.
+func (c *Circuit) verifyPublicInputs(api frontend.API) error {
+	data := []frontend.Variable{c.OldRoot, c.NewRoot, c.DepositHash, c.WithdrawalHash, c.DataHash}
+	if !c.commitment {
+		for i := range data {
+			api.AssertIsEqual(c.PublicInputs[i], data[i])
+		}
+		api.AssertIsEqual(c.PublicInputs[len(data)], c.BatchNumber)
+		return nil
+	}
+	commitment, err := publicCommitment(api, data, c.BatchNumber)
+	if err != nil {
+		return err
 	}
+	api.AssertIsEqual(c.PublicInputs[0], commitment)
 	return nil
 }
 
+// slotData returns the fields of a slot that DataHash hashes (type, token id,
+// sender and receiver index, nonce, amount, fee, installed key), zeroing the
+// ones the slot's type does not use as TxData does.
+func slotData(api frontend.API, kind txKind, t TransferConstraints, sender, receiver AccountConstraints) []frontend.Variable {
+	movesToken := api.Add(kind.transfer, kind.deposit, kind.withdrawal)
+	hasReceiver := api.Sub(1, kind.noop, kind.withdrawal)
+	installsKey := api.Add(kind.deposit, kind.create)
+	return []frontend.Variable{
+		t.Type,
+		api.Mul(movesToken, t.TokenID),
+		api.Mul(kind.signed, sender.Index),
+		api.Mul(hasReceiver, receiver.Index),
+		api.Mul(kind.signed, t.Nonce),
+		t.Amount,
+		api.Mul(kind.transfer, t.Fee),
+		api.Mul(installsKey, t.Receiver.A.X),
+		api.Mul(installsKey, t.Receiver.A.Y),
+	}
+}
+
+// txKind holds one boolean flag per transaction type for a batch slot (exactly
+// one of them is 1) plus flags derived from the type.
+type txKind struct {
+	transfer    frontend.Variable
+	noop        frontend.Variable
+	deposit     frontend.Variable
+	withdrawal  frontend.Variable
+	create      frontend.Variable
+	collectFees frontend.Variable
+
+	signed frontend.Variable // the slot needs the sender's signature
+}
+
+// decodeType turns a slot's Type into per-type flags and asserts the type is
+// one the circuit knows.
+func decodeType(api frontend.API, typ frontend.Variable) txKind {
+	k := txKind{
+		transfer:    api.IsZero(api.Sub(typ, uint64(TxTransfer))),
+		noop:        api.IsZero(api.Sub(typ, uint64(TxNoop))),
+		deposit:     api.IsZero(api.Sub(typ, uint64(TxDeposit))),
+		withdrawal:  api.IsZero(api.Sub(typ, uint64(TxWithdrawal))),
+		create:      api.IsZero(api.Sub(typ, uint64(TxCreate))),
+		collectFees: api.IsZero(api.Sub(typ, uint64(TxCollectFees))),
+	}
+	api.AssertIsEqual(api.Add(k.transfer, k.noop, k.deposit, k.withdrawal, k.create, k.collectFees), 1)
+	k.signed = api.Add(k.transfer, k.withdrawal)
+	return k
+}
+
+// assertIsEqualIf asserts a == b when cond is 1 and nothing when cond is 0.
+func assertIsEqualIf(api frontend.API, cond, a, b frontend.Variable) {
+	api.AssertIsEqual(api.Mul(cond, api.Sub(a, b)), 0)
+}
+
+// isEmpty returns 1 if a is the canonical empty account (identity key, zero
+// balances, zero nonce; see Account.IsEmpty) and 0 otherwise.
+func isEmpty(api frontend.API, a AccountConstraints) frontend.Variable {
+	empty := api.And(
+		api.And(api.IsZero(a.PubKey.A.X), api.IsZero(api.Sub(a.PubKey.A.Y, 1))),
+		api.IsZero(a.Nonce),
+	)
+	for _, b := range a.Balances {
+		empty = api.And(empty, api.IsZero(b))
+	}
+	return empty
+}
+
+// verifyNoop asserts that a no-op slot moves no value and leaves the state root
+// unchanged. Together with the nonce rule in verifyUpdate this makes the slot's
+// after-accounts equal to its before-accounts.
+func verifyNoop(api frontend.API, isNoop, amount, rootBefore, rootAfter frontend.Variable) {
+	api.AssertIsEqual(api.Mul(isNoop, amount), 0)
+	api.AssertIsEqual(api.Mul(isNoop, api.Sub(rootAfter, rootBefore)), 0)
+}
+
+// verifySingleWrite asserts that a slot writing a single leaf leaves the tree
+// unchanged on its other side, which verifyUpdate does not constrain: the
+// sender side of deposits, registrations and fee settlements ends on the
+// before root, and the receiver side of withdrawals on the after root. mid is
+// the root between the sender's and the receiver's writes.
+func verifySingleWrite(api frontend.API, kind txKind, rootBefore, mid, rootAfter frontend.Variable) {
+	assertIsEqualIf(api, api.Add(kind.deposit, kind.create, kind.collectFees), mid, rootBefore)
+	assertIsEqualIf(api, kind.withdrawal, rootAfter, mid)
+}
+
+// verifyDistinct asserts that a transfer's sender and receiver are different
+// accounts, as Operator.ApplyTransfer requires (ErrSelfTransfer), so the
+// circuit accepts exactly the transfers the operator applies.
+func verifyDistinct(api frontend.API, isTransfer frontend.Variable, sender, receiver AccountConstraints) {
+	api.AssertIsEqual(api.Mul(isTransfer, api.IsZero(api.Sub(sender.Index, receiver.Index))), 0)
+}
+
+// verifyValidUntil asserts that a transfer has not expired: batchNumber <=
+// validUntil. With both range-checked to 64 bits (Define checks batchNumber
+// once), the difference has integer semantics and only fits in 64 bits when it
+// is not negative.
+func verifyValidUntil(api frontend.API, rc frontend.Rangechecker, isTransfer, validUntil, batchNumber frontend.Variable) {
+	rc.Check(validUntil, 64)
+	rc.Check(api.Mul(isTransfer, api.Sub(validUntil, batchNumber)), 64)
+}
+
+// verifyCreate asserts that an account registration fills an empty leaf and
+// moves no value. verifyUpdate then installs the new key and keeps the zero
+// balance and nonce.
+func verifyCreate(api frontend.API, isCreate, amount frontend.Variable, receiverBefore AccountConstraints) {
+	api.AssertIsEqual(api.Mul(isCreate, amount), 0)
+	assertIsEqualIf(api, isCreate, isEmpty(api, receiverBefore), 1)
+}
+
+// verifyKeyIndex asserts that a slot installing a key, a registration or a
+// deposit to an empty leaf, writes the leaf at the key's position (see
+// KeyIndex), so a key can hold a single account.
+func verifyKeyIndex(api frontend.API, h hash.StateStorer, kind txKind, receiverBefore, receiverAfter AccountConstraints) {
+	install := api.Add(kind.create, api.Mul(kind.deposit, isEmpty(api, receiverBefore)))
+	assertIsEqualIf(api, install, receiverAfter.Index, gadget.KeyIndex(api, h, receiverAfter.PubKey, StateDepth))
+}
+
+// chainRoots asserts the batch is one continuous state transition: the first
+// transfer starts from oldRoot, each transfer starts from the root the previous
+// one ended on, and the last transfer ends on newRoot.
+func chainRoots(api frontend.API, oldRoot, newRoot frontend.Variable, before, after []frontend.Variable) {
+	api.AssertIsEqual(before[0], oldRoot)
+	for i := 1; i < len(before); i++ {
+		api.AssertIsEqual(before[i], after[i-1])
+	}
+	api.AssertIsEqual(after[len(after)-1], newRoot)
+}
+
 // bindTransfer asserts the transfer's keys/nonce match the sender/receiver
-// accounts, so the prover cannot sign for one account and update another.
+// accounts, so the prover cannot sign for one account and update another. The
+// receiver key is bound to the receiver's after-state, which for a deposit into
+// an empty slot is the key being installed.
 func bindTransfer(api frontend.API, t TransferConstraints, sender, receiver AccountConstraints) {
 	api.AssertIsEqual(t.Sender.A.X, sender.PubKey.A.X)
 	api.AssertIsEqual(t.Sender.A.Y, sender.PubKey.A.Y)
@@ -124,34 +449,92 @@ func bindTransfer(api frontend.API, t TransferConstraints, sender, receiver Acco
 	api.AssertIsEqual(t.Nonce, sender.Nonce)
 }
 
-// verifySignature checks the EdDSA signature over the MiMC hash of the transfer
-// fields (matching Transfer.preimage on the native side).
-func verifySignature(api frontend.API, curve twistededwards.Curve, h *mimc.MiMC, t TransferConstraints) error {
+// verifySignature checks the signature under auth over the hash of the slot's
+// fields, separated by the type tag and domain: the transfer message for
+// transfers (matching Transfer.preimage) and the withdrawal message for
+// withdrawals (matching Withdrawal.preimage). The separator is constant, so
+// the hasher absorbs it without constraints. The check applies to transfers
+// and withdrawals only: the other slots (no-ops, deposits, registrations and
+// fee collections) are unsigned, so they are checked against the identity key
+// instead of the sender's, which keeps the curve arithmetic well defined
+// whatever the slot's account holds, and their result is ignored.
+func verifySignature(api frontend.API, curve twistededwards.Curve, h hash.FieldHasher, auth Authorizer, d Domain, t TransferConstraints, kind txKind) error {
 	h.Reset()
-	h.Write(t.Nonce, t.Amount, t.Sender.A.X, t.Sender.A.Y, t.Receiver.A.X, t.Receiver.A.Y)
-	msg := h.Sum()
-
-	// eddsa.Verify (via IsValid) hashes H(R,A,msg) without resetting first, so the
-	// hasher must be in its initial state here. MiMC.Sum clears buffered data but
-	// keeps the chaining value, so an explicit Reset is required.
+	h.Write(uint64(TxTransfer), d.ChainID, d.InstanceID)
+	h.Write(t.Nonce, t.TokenID, t.Amount, t.Fee, t.ValidUntil, t.Sender.A.X, t.Sender.A.Y, t.Receiver.A.X, t.Receiver.A.Y)
+	transferMsg := h.Sum()
 	h.Reset()
-	return eddsa.Verify(curve, t.Signature, msg, t.Sender, h)
+	h.Write(uint64(TxWithdrawal), d.ChainID, d.InstanceID)
+	h.Write(t.Nonce, t.TokenID, t.Amount, t.Sender.A.X, t.Sender.A.Y, t.Recipient)
+	msg := api.Select(kind.withdrawal, h.Sum(), transferMsg)
+
+	signer := twistededwards.Point{
+		X: api.Select(kind.signed, t.Sender.A.X, 0),
+		Y: api.Select(kind.signed, t.Sender.A.Y, 1),
+	}
+	valid, err := auth.IsValid(api, curve, h, signer, t.Signature, msg)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(api.Or(valid, api.Sub(1, kind.signed)), 1)
+	return nil
 }
 
-// verifyUpdate asserts the state transition: nonce+1, amount <= balance, and the
-// balances move by exactly amount. Public keys and index are unchanged.
-func verifyUpdate(api frontend.API, senderBefore, receiverBefore, senderAfter, receiverAfter AccountConstraints, amount frontend.Variable) {
-	api.AssertIsEqual(api.Add(senderBefore.Nonce, 1), senderAfter.Nonce)
+// verifyUpdate asserts the state transition of one slot.
+//
+// Sender side: the nonce grows by 1 for signed slots (transfers and
+// withdrawals), the balance of token drops by the amount they move out, the
+// FeeToken balance drops by a transfer's fee, and the key is unchanged.
+//
+// Receiver side: the balance of token grows by the credited amount (transfers,
+// deposits and fee settlements), and the nonce is unchanged. The key is
+// unchanged too, except that a deposit into an empty slot and a registration
+// install a new key. Balances of the other tokens are unchanged on both sides.
+//
+// Indices never change: gadget.UpdateAccount asserts it for every write.
+// Deposits, withdrawals, registrations and fee settlements touch a single
+// leaf, so the rules leave one side of their slot unconstrained (the receiver
+// side of a withdrawal and the sender side of the others); verifySingleWrite
+// makes that side an identity update.
+//
+// token must be below NbTokens. Every balance, the amount and the fee are
+// range-checked to BalanceBits, which gives the field arithmetic integer
+// semantics: an amount above the sender balance makes the subtraction wrap to a
+// huge field element, and a receiver credit past the bound leaves a value wider
+// than BalanceBits, so both fail the range check.
+func verifyUpdate(api frontend.API, rc frontend.Rangechecker, kind txKind, senderBefore, receiverBefore, senderAfter, receiverAfter AccountConstraints, token, amount, fee frontend.Variable) {
+	rc.Check(amount, BalanceBits)
+	rc.Check(fee, BalanceBits)
+	for _, a := range []AccountConstraints{senderBefore, receiverBefore, senderAfter, receiverAfter} {
+		for _, b := range a.Balances {
+			rc.Check(b, BalanceBits)
+		}
+	}
+
+	hasSender := api.Sub(1, kind.deposit, kind.create, kind.collectFees)
+	hasReceiver := api.Sub(1, kind.withdrawal)
+	debit := api.Mul(kind.signed, amount)
+	credit := api.Mul(api.Add(kind.transfer, kind.deposit, kind.collectFees), amount)
+	var selected frontend.Variable = 0
+	for j := range senderBefore.Balances {
+		sel := api.IsZero(api.Sub(token, j))
+		selected = api.Add(selected, sel)
+
+		debitJ := api.Mul(sel, debit)
+		if j == FeeToken {
+			debitJ = api.Add(debitJ, api.Mul(kind.transfer, fee))
+		}
+		assertIsEqualIf(api, hasSender, api.Sub(senderBefore.Balances[j], debitJ), senderAfter.Balances[j])
+		assertIsEqualIf(api, hasReceiver, api.Add(receiverBefore.Balances[j], api.Mul(sel, credit)), receiverAfter.Balances[j])
+	}
+	api.AssertIsEqual(selected, 1)
 
-	api.AssertIsLessOrEqual(amount, senderBefore.Balance)
-	api.AssertIsEqual(api.Sub(senderBefore.Balance, amount), senderAfter.Balance)
-	api.AssertIsEqual(api.Add(receiverBefore.Balance, amount), receiverAfter.Balance)
+	assertIsEqualIf(api, hasSender, api.Add(senderBefore.Nonce, kind.signed), senderAfter.Nonce)
+	assertIsEqualIf(api, hasSender, senderBefore.PubKey.A.X, senderAfter.PubKey.A.X)
+	assertIsEqualIf(api, hasSender, senderBefore.PubKey.A.Y, senderAfter.PubKey.A.Y)
 
-	// identity is preserved
-	api.AssertIsEqual(senderBefore.Index, senderAfter.Index)
-	api.AssertIsEqual(senderBefore.PubKey.A.X, senderAfter.PubKey.A.X)
-	api.AssertIsEqual(senderBefore.PubKey.A.Y, senderAfter.PubKey.A.Y)
-	api.AssertIsEqual(receiverBefore.Index, receiverAfter.Index)
-	api.AssertIsEqual(receiverBefore.PubKey.A.X, receiverAfter.PubKey.A.X)
-	api.AssertIsEqual(receiverBefore.PubKey.A.Y, receiverAfter.PubKey.A.Y)
+	assertIsEqualIf(api, hasReceiver, receiverBefore.Nonce, receiverAfter.Nonce)
+	keepKey := api.Sub(hasReceiver, api.Mul(kind.deposit, isEmpty(api, receiverBefore)), kind.create)
+	assertIsEqualIf(api, keepKey, receiverBefore.PubKey.A.X, receiverAfter.PubKey.A.X)
+	assertIsEqualIf(api, keepKey, receiverBefore.PubKey.A.Y, receiverAfter.PubKey.A.Y)
 }
@@ -1,12 +1,18 @@
 package rollup
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"math/rand"
 	"testing"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/rangecheck"
 	"github.com/consensys/gnark/test"
 	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
 )
@@ -15,23 +21,27 @@ import (
 // and returns the witnesses plus the Merkle path length.
 func buildBatch(t testing.TB, nbAccounts, count int) ([]TransferWitness, int) {
 	t.Helper()
-	r := rand.New(rand.NewSource(99)) //#nosec G404 -- deterministic test
-	op := NewOperator(nbAccounts, cmimc.NewMiMC())
+	op, privs := newBatchOperator(t, nbAccounts)
+	witnesses := applyTransfers(t, op, privs, count)
+	return witnesses, len(witnesses[0].SenderProof.Path)
+}
 
-	privs := make([]eddsa.PrivateKey, nbAccounts)
-	for i := 0; i < nbAccounts; i++ {
-		acc, priv, err := NewAccount(i, uint64(100+i), r)
-		if err != nil {
-			t.Fatalf("account %d: %v", i, err)
-		}
-		op.AddAccount(acc)
-		privs[i] = priv
-	}
+// newBatchOperator builds the deterministic operator behind buildBatch: account
+// i has balance 100+i. The state is hashed with the suite selected by opts
+// (WithHashSuite).
+func newBatchOperator(t testing.TB, nbAccounts int, opts ...Option) (*Operator, []eddsa.PrivateKey) {
+	t.Helper()
+	r := rand.New(rand.NewSource(99)) //#nosec G404 -- deterministic test
+	return addAccounts(t, NewOperator(options(opts).hash.New(), opts...), nbAccounts, 100, r)
+}
 
+// applyTransfers applies `count` transfers of 1 from account 0 to account 1.
+func applyTransfers(t testing.TB, op *Operator, privs []eddsa.PrivateKey, count int) []TransferWitness {
+	t.Helper()
 	witnesses := make([]TransferWitness, count)
 	for k := 0; k < count; k++ {
-		sender, _ := op.ReadAccount(0)
-		receiver, _ := op.ReadAccount(1)
+		sender := accountOf(t, op, privs[0])
+		receiver := accountOf(t, op, privs[1])
 		transfer := NewTransfer(1, sender.PubKey, receiver.PubKey, sender.Nonce)
 		if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
 			t.Fatalf("sign %d: %v", k, err)
@@ -42,7 +52,7 @@ func buildBatch(t testing.TB, nbAccounts, count int) ([]TransferWitness, int) {
 		}
 		witnesses[k] = w
 	}
-	return witnesses, len(witnesses[0].SenderProofBefore.Path)
+	return witnesses
 }
 
 func TestCircuitSolvesBatch1(t *testing.T) {
@@ -70,14 +80,28 @@ func TestCircuitRejectsTamperedRoot(t *testing.T) {
 	circuit := New(len(witnesses), pathLen)
 	assignment := Assign(witnesses, pathLen)
 
-	// Corrupt the public "after" root: the proof should no longer solve.
-	assignment.RootsAfter[0] = toElem(123456789)
+	// Corrupt the public new root: the proof should no longer solve.
+	assignment.PublicInputs[1] = toElem(123456789)
 
 	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err == nil {
 		t.Fatal("circuit solved with a tampered root, but should not")
 	}
 }
 
+// TestCircuitRejectsBrokenChain feeds the same transfer twice, so the second
+// transfer does not start from the root the first one ended on. Each transfer is
+// individually valid; only the root chaining rejects the batch.
+func TestCircuitRejectsBrokenChain(t *testing.T) {
+	witnesses, pathLen := buildBatch(t, 16, 1)
+	replayed := []TransferWitness{witnesses[0], witnesses[0]}
+	circuit := New(len(replayed), pathLen)
+	assignment := Assign(replayed, pathLen)
+
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit solved a batch whose roots do not chain, but should not")
+	}
+}
+
 func TestCircuitProveVerifyBatch3(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping multi-transfer proving in -short mode")
@@ -113,24 +137,12 @@ func TestCircuitProveVerifyMultiPair(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping multi-pair proving in -short mode")
 	}
-	const n = 16
-	r := rand.New(rand.NewSource(123)) //#nosec G404 -- deterministic test
-	op := NewOperator(n, cmimc.NewMiMC())
-	privs := make([]eddsa.PrivateKey, n)
-	for i := 0; i < n; i++ {
-		acc, priv, err := NewAccount(i, uint64(200+i), r)
-		if err != nil {
-			t.Fatalf("account %d: %v", i, err)
-		}
-		op.AddAccount(acc)
-		privs[i] = priv
-	}
-
+	op, privs := newBatchOperator(t, 16)
 	pairs := [][2]int{{0, 1}, {2, 3}}
 	witnesses := make([]TransferWitness, 0, len(pairs))
 	for _, p := range pairs {
-		sender, _ := op.ReadAccount(uint64(p[0]))
-		receiver, _ := op.ReadAccount(uint64(p[1]))
+		sender := accountOf(t, op, privs[p[0]])
+		receiver := accountOf(t, op, privs[p[1]])
 		transfer := NewTransfer(2, sender.PubKey, receiver.PubKey, sender.Nonce)
 		if _, err := transfer.Sign(privs[p[0]], cmimc.NewMiMC()); err != nil {
 			t.Fatalf("sign %v: %v", p, err)
@@ -142,10 +154,689 @@ func TestCircuitProveVerifyMultiPair(t *testing.T) {
 		witnesses = append(witnesses, w)
 	}
 
-	pathLen := len(witnesses[0].SenderProofBefore.Path)
+	pathLen := len(witnesses[0].SenderProof.Path)
 	circuit := New(len(witnesses), pathLen)
 	assignment := Assign(witnesses, pathLen)
 	if err := prove.Run(circuit, assignment); err != nil {
 		t.Fatalf("expected multi-pair batch proof to verify: %v", err)
 	}
 }
+
+// updateCircuit exercises verifyUpdate in isolation, so the balance rules can be
+// tested with values no honest operator would produce.
+type updateCircuit struct {
+	SenderBefore, ReceiverBefore, SenderAfter, ReceiverAfter AccountConstraints
+	Amount                                                   frontend.Variable
+}
+
+func (c *updateCircuit) Define(api frontend.API) error {
+	verifyUpdate(api, rangecheck.New(api), decodeType(api, uint64(TxTransfer)), c.SenderBefore, c.ReceiverBefore, c.SenderAfter, c.ReceiverAfter, FeeToken, c.Amount, 0)
+	return nil
+}
+
+// newUpdateCircuit returns an updateCircuit with its balance slices allocated.
+func newUpdateCircuit() *updateCircuit {
+	as := newAccounts(4)
+	return &updateCircuit{SenderBefore: as[0], ReceiverBefore: as[1], SenderAfter: as[2], ReceiverAfter: as[3]}
+}
+
+// newUpdateAssignment returns an assignment moving amount from sender to
+// receiver with plain field arithmetic, i.e. without any bound applied.
+func newUpdateAssignment(t *testing.T, senderBal, receiverBal, amount fr.Element) *updateCircuit {
+	t.Helper()
+	r := rand.New(rand.NewSource(11)) //#nosec G404 -- deterministic test
+	sender, _, err := NewAccount(0, r)
+	if err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	receiver, _, err := NewAccount(0, r)
+	if err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	sender.Balances[FeeToken], receiver.Balances[FeeToken] = senderBal, receiverBal
+	senderAfter, receiverAfter := sender, receiver
+	senderAfter.Nonce++
+	senderAfter.Balances[FeeToken].Sub(&senderBal, &amount)
+	receiverAfter.Balances[FeeToken].Add(&receiverBal, &amount)
+
+	a := newUpdateCircuit()
+	a.Amount = amount
+	assignAccount(&a.SenderBefore, sender)
+	assignAccount(&a.ReceiverBefore, receiver)
+	assignAccount(&a.SenderAfter, senderAfter)
+	assignAccount(&a.ReceiverAfter, receiverAfter)
+	return a
+}
+
+func TestVerifyUpdateRangeChecks(t *testing.T) {
+	var maxBalance fr.Element
+	maxBalance.SetUint64(^uint64(0)) // 2^64 - 1
+
+	cases := []struct {
+		name                     string
+		sender, receiver, amount fr.Element
+		ok                       bool
+	}{
+		{"valid", toElem(50), toElem(7), toElem(20), true},
+		{"receiver at bound", toElem(50), toElem(^uint64(0) - 20), toElem(20), true},
+		{"amount above sender balance", toElem(5), toElem(0), toElem(10), false},
+		{"receiver overflow", toElem(50), maxBalance, toElem(1), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assignment := newUpdateAssignment(t, tc.sender, tc.receiver, tc.amount)
+			err := test.IsSolved(newUpdateCircuit(), assignment, ecc.BN254.ScalarField())
+			if tc.ok && err != nil {
+				t.Fatalf("expected the update to solve: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("update solved, but should violate the balance range")
+			}
+		})
+	}
+}
+
+// solveCase is a table entry of a batch scenario test. witnesses and
+// assignment, when set, tamper with the scenario's batch before and after it is
+// assigned; ok tells whether the circuit must still solve it.
+type solveCase struct {
+	name       string
+	witnesses  func(ws []TransferWitness)
+	assignment func(a *Circuit, ws []TransferWitness)
+	ok         bool
+}
+
+// runSolveCases builds a fresh batch with build for each case and checks it
+// against a circuit of its size built with opts.
+func runSolveCases(t *testing.T, build func(t *testing.T) ([]TransferWitness, int), cases []solveCase, opts ...Option) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			witnesses, pathLen := build(t)
+			if tc.witnesses != nil {
+				tc.witnesses(witnesses)
+			}
+			assignment := Assign(witnesses, pathLen, opts...)
+			if tc.assignment != nil {
+				tc.assignment(assignment, witnesses)
+			}
+			err := test.IsSolved(New(len(witnesses), pathLen, opts...), assignment, ecc.BN254.ScalarField())
+			if tc.ok && err != nil {
+				t.Fatalf("expected the batch to solve: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("batch solved, but should not")
+			}
+		})
+	}
+}
+
+// republish assigns the public data of ws, edited by edit, to both the
+// circuit's copy and PublicInputs, so that the assignment can only fail on the
+// circuit's checks of that data against the batch.
+func republish(a *Circuit, ws []TransferWitness, edit func(p *PublicData)) {
+	p := BatchPublicData(ws)
+	edit(&p)
+	a.OldRoot, a.NewRoot = p.OldRoot, p.NewRoot
+	a.DepositHash, a.WithdrawalHash, a.DataHash = p.DepositHash, p.WithdrawalHash, p.DataHash
+	a.BatchNumber = p.BatchNumber
+	a.PublicInputs = PublicAssignment(p).PublicInputs
+}
+
+// buildPaddedBatch applies `count` transfers (as buildBatch) and pads the batch
+// with no-ops up to batchSize.
+func buildPaddedBatch(t testing.TB, count, batchSize int) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16)
+	padded, err := op.PadBatch(applyTransfers(t, op, privs, count), batchSize)
+	if err != nil {
+		t.Fatalf("pad: %v", err)
+	}
+	return padded, len(padded[0].SenderProof.Path)
+}
+
+func TestCircuitPaddedBatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		count    int
+		disguise bool // relabel the first transfer as a no-op
+		ok       bool
+	}{
+		{"no transfers", 0, false, true},
+		{"one transfer", 1, false, true},
+		{"two transfers", 2, false, true},
+		// a relabelled transfer skips its signature check, so the no-op rules
+		// (no value moved, nonce and root unchanged) must reject it
+		{"transfer disguised as no-op", 1, true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			witnesses, pathLen := buildPaddedBatch(t, tc.count, 3)
+			if tc.disguise {
+				witnesses[0].Type = TxNoop
+			}
+			err := test.IsSolved(New(3, pathLen), Assign(witnesses, pathLen), ecc.BN254.ScalarField())
+			if tc.ok && err != nil {
+				t.Fatalf("expected the padded batch to solve: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("padded batch solved, but should not")
+			}
+		})
+	}
+}
+
+// TestCircuitPaddedBatchSameKeys proves a full batch and a padded one with the
+// same compiled circuit and keys.
+func TestCircuitPaddedBatchSameKeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping padded-batch proving in -short mode")
+	}
+	const batchSize = 2
+	full, pathLen := buildPaddedBatch(t, batchSize, batchSize)
+	partial, _ := buildPaddedBatch(t, 1, batchSize)
+
+	ccs, err := prove.Compile(New(batchSize, pathLen))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	keys, err := prove.Setup(ccs)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	for name, witnesses := range map[string][]TransferWitness{"full": full, "padded": partial} {
+		proof, public, err := prove.Prove(ccs, keys.PK, Assign(witnesses, pathLen))
+		if err != nil {
+			t.Fatalf("%s: prove: %v", name, err)
+		}
+		if err := prove.Verify(proof, keys.VK, public); err != nil {
+			t.Fatalf("%s: verify: %v", name, err)
+		}
+	}
+}
+
+// buildDepositBatch deposits to a new key, transfers from the new account to
+// account 0, then deposits again to account 1.
+func buildDepositBatch(t *testing.T) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 2)
+	pub, priv := newKey(t, 22)
+	acc0 := accountOf(t, op, privs[0])
+	acc1 := accountOf(t, op, privs[1])
+
+	d1, err := op.ApplyDeposit(NewDeposit(50, pub))
+	if err != nil {
+		t.Fatalf("deposit to new key: %v", err)
+	}
+	transfer := NewTransfer(20, pub, acc0.PubKey, 0)
+	if _, err := transfer.Sign(priv, cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer from deposited account: %v", err)
+	}
+	d2, err := op.ApplyDeposit(NewDeposit(5, acc1.PubKey))
+	if err != nil {
+		t.Fatalf("deposit to existing account: %v", err)
+	}
+	witnesses := []TransferWitness{d1, tw, d2}
+	return witnesses, len(witnesses[0].SenderProof.Path)
+}
+
+func TestCircuitDeposits(t *testing.T) {
+	runSolveCases(t, buildDepositBatch, []solveCase{
+		{name: "valid", ok: true},
+		{name: "public data republished", ok: true, assignment: func(a *Circuit, ws []TransferWitness) {
+			republish(a, ws, func(p *PublicData) {})
+		}},
+		{name: "deposit hash omits a consumed deposit", assignment: func(a *Circuit, ws []TransferWitness) {
+			republish(a, ws, func(p *PublicData) {
+				p.DepositHash = DepositHash(batchDeposits(ws)[:1], cmimc.NewMiMC())
+			})
+		}},
+		{name: "deposit hash in another order", assignment: func(a *Circuit, ws []TransferWitness) {
+			ds := batchDeposits(ws)
+			republish(a, ws, func(p *PublicData) {
+				p.DepositHash = DepositHash([]Deposit{ds[1], ds[0]}, cmimc.NewMiMC())
+			})
+		}},
+		// an unsigned deposit relabelled as a transfer has no signature
+		{name: "deposit relabelled as transfer", witnesses: func(ws []TransferWitness) {
+			ws[2].Type = TxTransfer
+			ws[2].SignatureRaw = ws[1].SignatureRaw
+		}},
+	})
+}
+
+// buildWithdrawalBatch applies a transfer 0->1 and then withdrawals from 1 and
+// from 0.
+func buildWithdrawalBatch(t *testing.T) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16)
+	witnesses := applyTransfers(t, op, privs, 1)
+	for k, from := range []int{1, 0} {
+		acc := accountOf(t, op, privs[from])
+		wd := NewWithdrawal(uint64(3+k), acc.PubKey, [20]byte{byte(k + 1)}, acc.Nonce)
+		if _, err := wd.Sign(privs[from], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		w, err := op.ApplyWithdrawal(wd)
+		if err != nil {
+			t.Fatalf("withdraw from %d: %v", from, err)
+		}
+		witnesses = append(witnesses, w)
+	}
+	return witnesses, len(witnesses[0].SenderProof.Path)
+}
+
+func TestCircuitWithdrawals(t *testing.T) {
+	runSolveCases(t, buildWithdrawalBatch, []solveCase{
+		{name: "valid", ok: true},
+		{name: "public data republished", ok: true, assignment: func(a *Circuit, ws []TransferWitness) {
+			republish(a, ws, func(p *PublicData) {})
+		}},
+		// a bridge must not be able to pay the exits to another address
+		{name: "withdrawal hash with a redirected exit", assignment: func(a *Circuit, ws []TransferWitness) {
+			es := batchExits(ws)
+			es[0].Recipient = [20]byte{9}
+			republish(a, ws, func(p *PublicData) {
+				p.WithdrawalHash = WithdrawalHash(es, cmimc.NewMiMC())
+			})
+		}},
+		{name: "withdrawal hash in another order", assignment: func(a *Circuit, ws []TransferWitness) {
+			es := batchExits(ws)
+			republish(a, ws, func(p *PublicData) {
+				p.WithdrawalHash = WithdrawalHash([]Exit{es[1], es[0]}, cmimc.NewMiMC())
+			})
+		}},
+		// the recipient and the matching public hash change together, but the
+		// signature does not cover the new recipient
+		{name: "recipient the owner did not sign", witnesses: func(ws []TransferWitness) {
+			ws[1].Recipient = [20]byte{9}
+		}},
+	})
+}
+
+// TestCircuitRejectsWriteOnUnusedSide checks that the receiver side of a
+// withdrawal, which the update rules leave free, cannot write another leaf.
+func TestCircuitRejectsWriteOnUnusedSide(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	acc := accountOf(t, op, privs[0])
+	wd := NewWithdrawal(3, acc.PubKey, testRecipient, acc.Nonce)
+	if _, err := wd.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	w, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+
+	// credit account 5 on top of the debit, as a second write of the slot
+	before := accountOf(t, op, privs[5])
+	after := before
+	after.Balances[FeeToken].SetUint64(1_000_000)
+	w.ReceiverBefore, w.ReceiverAfter = before, after
+	w.ReceiverProof = op.Proof(before.Index)
+	op.writeAccount(after)
+	w.RootAfter, _ = op.Root()
+
+	pathLen := len(w.SenderProof.Path)
+	if err := test.IsSolved(New(1, pathLen), Assign([]TransferWitness{w}, pathLen), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a withdrawal that also credits another account")
+	}
+}
+
+func TestCircuitRejectsExpiredTransfer(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	op.SetBatchNumber(5)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	transfer := NewTransfer(4, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.ValidUntil = 5
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	w, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	pathLen := len(w.SenderProof.Path)
+	if err := test.IsSolved(New(1, pathLen), Assign([]TransferWitness{w}, pathLen), ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("circuit should solve a transfer in its last valid batch: %v", err)
+	}
+
+	// the same slot proven as part of a later batch
+	w.BatchNumber = 6
+	if err := test.IsSolved(New(1, pathLen), Assign([]TransferWitness{w}, pathLen), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a transfer in a batch past its ValidUntil")
+	}
+}
+
+func TestAssignRejectsMixedBatchNumbers(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	witnesses := applyTransfers(t, op, privs, 2)
+	// the public BatchNumber is the first slot's, which the second was not
+	// checked against
+	witnesses[1].BatchNumber = 1
+	defer func() {
+		if r := recover(); r != ErrMixedBatchNumber {
+			t.Fatalf("expected a panic with ErrMixedBatchNumber, got %v", r)
+		}
+	}()
+	Assign(witnesses, len(witnesses[0].SenderProof.Path))
+}
+
+func TestCircuitBindsDomain(t *testing.T) {
+	domain := Domain{ChainID: 11155111, InstanceID: 3}
+	op, privs := newBatchOperator(t, 8, WithDomain(domain))
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	transfer := NewTransfer(4, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.Domain = domain
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	wd := NewWithdrawal(3, receiver.PubKey, testRecipient, receiver.Nonce)
+	wd.Domain = domain
+	if _, err := wd.Sign(privs[1], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ww, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	witnesses := []TransferWitness{tw, ww}
+	pathLen := len(tw.SenderProof.Path)
+
+	assignment := Assign(witnesses, pathLen, WithDomain(domain))
+	if err := test.IsSolved(New(2, pathLen, WithDomain(domain)), assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("circuit should solve a batch signed for its domain: %v", err)
+	}
+	if err := test.IsSolved(New(2, pathLen), assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit of the zero domain accepted signatures made for another one")
+	}
+}
+
+// buildCreateBatch registers a new key, funds it with a deposit and transfers
+// out of it.
+func buildCreateBatch(t *testing.T) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 1)
+	acc0 := accountOf(t, op, privs[0])
+	pub, priv := newKey(t, 42)
+
+	create, err := op.CreateAccount(pub)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	deposit, err := op.ApplyDeposit(NewDeposit(9, pub))
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	transfer := NewTransfer(4, pub, acc0.PubKey, 0)
+	if _, err := transfer.Sign(priv, cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	witnesses := []TransferWitness{create, deposit, tw}
+	return witnesses, len(witnesses[0].SenderProof.Path)
+}
+
+func TestCircuitCreate(t *testing.T) {
+	runSolveCases(t, buildCreateBatch, []solveCase{
+		{name: "valid", ok: true},
+		// a deposit into an existing account relabelled as a registration: the
+		// leaf was not empty
+		{name: "registration over an occupied leaf", witnesses: func(ws []TransferWitness) {
+			ws[1].Type = TxCreate
+			ws[1].Amount.SetZero()
+		}},
+	})
+}
+
+// TestCircuitBindsKeyIndex checks that a registration, or a deposit that
+// creates an account, only solves at the leaf of the key's index.
+func TestCircuitBindsKeyIndex(t *testing.T) {
+	for _, typ := range []TxType{TxCreate, TxDeposit} {
+		for _, moved := range []bool{false, true} {
+			t.Run(fmt.Sprintf("type %d moved %t", typ, moved), func(t *testing.T) {
+				op, _ := newBatchOperator(t, 1)
+				pub, _ := newKey(t, 42)
+				index := KeyIndex(pub, cmimc.NewMiMC())
+				if moved {
+					index = index.sibling()
+				}
+				before := op.ReadAccount(index)
+				proof := op.Proof(index)
+				after := before
+				after.PubKey = pub
+				w := TransferWitness{Type: typ, ReceiverPubKeyRaw: pub.Bytes()}
+				if typ == TxDeposit {
+					w.Amount.SetUint64(5)
+					after.Balances[FeeToken] = w.Amount
+				}
+				op.writeAccount(after)
+				op.setReceiverWrite(&w, before, after, proof)
+
+				err := test.IsSolved(New(1, StateDepth+1), Assign([]TransferWitness{w}, StateDepth+1), ecc.BN254.ScalarField())
+				if !moved && err != nil {
+					t.Fatalf("expected the key's leaf to solve: %v", err)
+				}
+				if moved && err == nil {
+					t.Fatal("circuit accepted a key installed away from its index")
+				}
+			})
+		}
+	}
+}
+
+// TestCircuitRejectsSelfTransfer checks that a transfer from an account to
+// itself is rejected natively and cannot be proven even with the witness of a
+// sequential update (debit and nonce bump, then the credit on top).
+func TestCircuitRejectsSelfTransfer(t *testing.T) {
+	op, privs := newBatchOperator(t, 4)
+	acc := accountOf(t, op, privs[0])
+	transfer := NewTransfer(5, acc.PubKey, acc.PubKey, acc.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	root, _ := op.Root()
+	if _, err := op.ApplyTransfer(transfer); !errors.Is(err, ErrSelfTransfer) {
+		t.Fatalf("expected ErrSelfTransfer, got %v", err)
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, root) {
+		t.Fatal("rejected self-transfer changed the state")
+	}
+
+	w := TransferWitness{
+		Type:              TxTransfer,
+		Amount:            transfer.Amount,
+		SenderPubKeyRaw:   acc.PubKey.Bytes(),
+		ReceiverPubKeyRaw: acc.PubKey.Bytes(),
+		SignatureRaw:      transfer.SignatureRaw,
+		SenderBefore:      acc,
+	}
+	w.SenderProof = op.Proof(acc.Index)
+	w.RootBefore = w.SenderProof.RootHash
+
+	debited := acc
+	debited.Nonce++
+	debited.Balances[FeeToken].Sub(&debited.Balances[FeeToken], &transfer.Amount)
+	op.writeAccount(debited)
+	w.SenderAfter, w.ReceiverBefore = debited, debited
+	w.ReceiverProof = op.Proof(acc.Index)
+
+	credited := debited
+	credited.Balances[FeeToken].Add(&credited.Balances[FeeToken], &transfer.Amount)
+	op.writeAccount(credited)
+	w.ReceiverAfter = credited
+	w.RootAfter, _ = op.Root()
+
+	pathLen := len(w.SenderProof.Path)
+	if err := test.IsSolved(New(1, pathLen), Assign([]TransferWitness{w}, pathLen), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a self-transfer")
+	}
+}
+
+// TestCircuitRejectsEmptySender checks that a signed slot cannot spend from an
+// empty leaf. Its identity key verifies a signature with R = [S]B for any
+// message, so a zero-amount transfer from it would otherwise prove without the
+// operator holding any key.
+func TestCircuitRejectsEmptySender(t *testing.T) {
+	op, privs := newBatchOperator(t, 4)
+	sender := op.ReadAccount(testIndex(1))
+	receiver := accountOf(t, op, privs[1])
+	if !sender.IsEmpty() {
+		t.Fatal("the sender's leaf is not empty")
+	}
+	transfer := NewTransfer(0, sender.PubKey, receiver.PubKey, sender.Nonce)
+	if _, err := op.ApplyTransfer(transfer); !errors.Is(err, ErrNonExistingAccount) {
+		t.Fatalf("expected ErrNonExistingAccount, got %v", err)
+	}
+
+	// the identity R and a zero S are a valid EdDSA signature by the identity
+	var forged eddsa.Signature
+	forged.R.Y.SetOne()
+	w := TransferWitness{
+		Type:              TxTransfer,
+		SenderPubKeyRaw:   sender.PubKey.Bytes(),
+		ReceiverPubKeyRaw: receiver.PubKey.Bytes(),
+		SignatureRaw:      forged.Bytes(),
+		SenderBefore:      sender,
+		ReceiverBefore:    receiver,
+		ReceiverAfter:     receiver,
+	}
+	w.SenderProof = op.Proof(sender.Index)
+	w.RootBefore = w.SenderProof.RootHash
+	after := sender
+	after.Nonce++
+	op.writeAccount(after)
+	w.SenderAfter = after
+	w.ReceiverProof = op.Proof(receiver.Index)
+	w.RootAfter, _ = op.Root()
+
+	pathLen := len(w.SenderProof.Path)
+	if err := test.IsSolved(New(1, pathLen), Assign([]TransferWitness{w}, pathLen), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a transfer from an empty leaf")
+	}
+}
+
+// buildFeeBatch applies two fee-paying transfers with account 5 as the fee
+// collector. The fees are not collected yet.
+func buildFeeBatch(t *testing.T) (*Operator, []eddsa.PrivateKey, []TransferWitness) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16)
+	if err := op.SetFeeCollector(indexOf(t, op, privs[5])); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	var witnesses []TransferWitness
+	for k, fee := range []uint64{2, 3} {
+		sender := accountOf(t, op, privs[0])
+		receiver := accountOf(t, op, privs[1])
+		transfer := NewTransferWithFee(4, fee, sender.PubKey, receiver.PubKey, sender.Nonce)
+		if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign %d: %v", k, err)
+		}
+		w, err := op.ApplyTransfer(transfer)
+		if err != nil {
+			t.Fatalf("apply %d: %v", k, err)
+		}
+		witnesses = append(witnesses, w)
+	}
+	return op, privs, witnesses
+}
+
+func TestCircuitFees(t *testing.T) {
+	cases := []struct {
+		name      string
+		batchSize int // padded size; 0 leaves the fees uncollected
+		collector int // account whose index the circuit is built with
+		ok        bool
+	}{
+		{"collected", 4, 5, true},
+		{"credited to another account", 4, 6, false},
+		{"uncollected", 0, 5, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			op, privs, witnesses := buildFeeBatch(t)
+			if tc.batchSize > 0 {
+				var err error
+				if witnesses, err = op.PadBatch(witnesses, tc.batchSize); err != nil {
+					t.Fatalf("pad: %v", err)
+				}
+				if witnesses[2].Type != TxCollectFees {
+					t.Fatal("padding must settle the pending fees first")
+				}
+			}
+			pathLen := len(witnesses[0].SenderProof.Path)
+			circuit := New(len(witnesses), pathLen, WithFeeCollector(indexOf(t, op, privs[tc.collector])))
+			err := test.IsSolved(circuit, Assign(witnesses, pathLen), ecc.BN254.ScalarField())
+			if tc.ok && err != nil {
+				t.Fatalf("expected the batch to solve: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("batch solved, but should not pay the fees to the collector")
+			}
+		})
+	}
+}
+
+// buildTokenBatch deposits token 2 to account 0, transfers some of it to
+// account 1 with a FeeToken fee, withdraws token 2 from account 1 and settles
+// the fee.
+func buildTokenBatch(t *testing.T) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16)
+	acc0 := accountOf(t, op, privs[0])
+	acc1 := accountOf(t, op, privs[1])
+
+	d := NewDeposit(40, acc0.PubKey)
+	d.TokenID = 2
+	dw, err := op.ApplyDeposit(d)
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	transfer := NewTransferWithFee(15, 2, acc0.PubKey, acc1.PubKey, acc0.Nonce)
+	transfer.TokenID = 2
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign transfer: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	wd := NewWithdrawal(6, acc1.PubKey, testRecipient, acc1.Nonce)
+	wd.TokenID = 2
+	if _, err := wd.Sign(privs[1], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign withdrawal: %v", err)
+	}
+	ww, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	witnesses, err := op.PadBatch([]TransferWitness{dw, tw, ww}, 4)
+	if err != nil {
+		t.Fatalf("pad: %v", err)
+	}
+	return witnesses, len(witnesses[0].SenderProof.Path)
+}
+
+func TestCircuitTokens(t *testing.T) {
+	runSolveCases(t, buildTokenBatch, []solveCase{
+		{name: "valid", ok: true},
+		// the transfer claims another token than the one the accounts were
+		// updated in
+		{name: "swapped token", assignment: func(a *Circuit, _ []TransferWitness) {
+			a.Transfers[1].TokenID = 1
+		}},
+	})
+}
@@ -0,0 +1,124 @@
+package rollup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/sha2"
+	"github.com/consensys/gnark/std/math/bits"
+	"github.com/consensys/gnark/std/math/uints"
+)
+
+// CommitmentBits is the bit length of the public-input commitment: the SHA-256
+// digest is truncated to its low CommitmentBits bits so it always fits in the
+// BN254 scalar field.
+const CommitmentBits = 253
+
+// PublicData is the data a batch proof attests to, in the order of
+// Circuit.PublicInputs. The roots and hashes are field elements in 32-byte
+// big-endian form.
+type PublicData struct {
+	OldRoot        []byte
+	NewRoot        []byte
+	DepositHash    []byte
+	WithdrawalHash []byte
+	DataHash       []byte
+	BatchNumber    uint64 // the batch's number, which no applied transfer has expired by
+}
+
+// values returns the public data in PublicInputs order, each as a 32-byte
+// big-endian field element.
+func (p PublicData) values() [][]byte {
+	var n fr.Element
+	n.SetUint64(p.BatchNumber)
+	nb := n.Bytes()
+	return [][]byte{p.OldRoot, p.NewRoot, p.DepositHash, p.WithdrawalHash, p.DataHash, nb[:]}
+}
+
+// BatchPublicData returns the public data of a batch of consecutive witnesses:
+// the first and last roots, the hashes of its deposits, exits and data, under
+// the hash suite selected by opts, and the batch number its slots were applied
+// in.
+func BatchPublicData(witnesses []TransferWitness, opts ...Option) PublicData {
+	suite := options(opts).hash
+	var p PublicData
+	if len(witnesses) > 0 {
+		p.OldRoot = witnesses[0].RootBefore
+		p.NewRoot = witnesses[len(witnesses)-1].RootAfter
+		p.BatchNumber = witnesses[0].BatchNumber
+	}
+	p.DepositHash = DepositHash(batchDeposits(witnesses), suite.New())
+	p.WithdrawalHash = WithdrawalHash(batchExits(witnesses), suite.New())
+	p.DataHash = DataHash(BatchData(witnesses), suite.New())
+	return p
+}
+
+// PublicCommitment returns the single public input of a circuit built with
+// WithPublicCommitment:
+//
+//	SHA-256(oldRoot || newRoot || depositHash || withdrawalHash || dataHash || batchNumber) mod 2^CommitmentBits
+//
+// where the roots and hashes are 32-byte big-endian field elements and the
+// batch number is 8 big-endian bytes, which keeps the preimage within three
+// SHA-256 blocks. The result is 32 big-endian bytes. On-chain it is
+//
+//	uint256(sha256(abi.encodePacked(oldRoot, newRoot, depositHash, withdrawalHash, dataHash, uint64(batchNumber)))) & ((1 << 253) - 1)
+func PublicCommitment(p PublicData) []byte {
+	h := sha256.New()
+	vs := p.values()
+	for _, v := range vs[:len(vs)-1] {
+		var e fr.Element
+		e.SetBytes(v)
+		b := e.Bytes()
+		h.Write(b[:])
+	}
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], p.BatchNumber)
+	h.Write(n[:])
+	d := h.Sum(nil)
+	d[0] &= 0xff >> (256 - CommitmentBits)
+	return d
+}
+
+// publicCommitment is the in-circuit counterpart of PublicCommitment over the
+// given roots and hashes and the batch number, which it range-checks to 64
+// bits.
+func publicCommitment(api frontend.API, values []frontend.Variable, batchNumber frontend.Variable) (frontend.Variable, error) {
+	bapi, err := uints.NewBytes(api)
+	if err != nil {
+		return nil, err
+	}
+	h, err := sha2.New(api)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		// canonical little-endian bits, padded to 32 bytes and written big-endian
+		vb := append(bits.ToBinary(api, v), 0, 0)
+		msg := make([]uints.U8, 32)
+		for k := range msg {
+			msg[31-k] = bapi.ValueOf(bits.FromBinary(api, vb[8*k:8*k+8]))
+		}
+		h.Write(msg)
+	}
+	nb := bits.ToBinary(api, batchNumber, bits.WithNbDigits(64))
+	msg := make([]uints.U8, 8)
+	for k := range msg {
+		msg[7-k] = bapi.ValueOf(bits.FromBinary(api, nb[8*k:8*k+8]))
+	}
+	h.Write(msg)
+
+	digest := h.Sum()
+	var out frontend.Variable = 0
+	for i, b := range digest {
+		v := bapi.Value(b)
+		if i == 0 {
+			top := bits.ToBinary(api, v, bits.WithNbDigits(8))
+			v = bits.FromBinary(api, top[:8-(256-CommitmentBits)])
+		}
+		out = api.Add(api.Mul(out, 256), v)
+	}
+	return out, nil
+}
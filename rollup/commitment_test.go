@@ -0,0 +1,73 @@
+package rollup
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+)
+
+func TestPublicCommitmentFitsField(t *testing.T) {
+	witnesses, _ := buildWithdrawalBatch(t)
+	p := BatchPublicData(witnesses)
+	c := PublicCommitment(p)
+	if got := new(big.Int).SetBytes(c).BitLen(); got > CommitmentBits {
+		t.Fatalf("commitment has %d bits, want at most %d", got, CommitmentBits)
+	}
+	p.DataHash = []byte{3}
+	if d := PublicCommitment(p); bytes.Equal(c, d) {
+		t.Fatal("commitment does not depend on the data hash")
+	}
+}
+
+func TestCircuitSolvesPublicCommitment(t *testing.T) {
+	witnesses, pathLen := buildWithdrawalBatch(t)
+	circuit := New(len(witnesses), pathLen, WithPublicCommitment())
+	assignment := Assign(witnesses, pathLen, WithPublicCommitment())
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("circuit should solve with a public commitment: %v", err)
+	}
+
+	// a commitment over other public data must not verify
+	assignment.PublicInputs[0] = PublicCommitment(BatchPublicData(witnesses[:1]))
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a commitment over other public data")
+	}
+}
+
+// TestPublicAssignmentMatchesProver checks that the public witness a verifier
+// builds from the public data alone is the one the prover's assignment yields.
+func TestPublicAssignmentMatchesProver(t *testing.T) {
+	witnesses, pathLen := buildWithdrawalBatch(t)
+	p := PublicData{
+		OldRoot:        witnesses[0].RootBefore,
+		NewRoot:        witnesses[len(witnesses)-1].RootAfter,
+		DepositHash:    DepositHash(nil, cmimc.NewMiMC()),
+		WithdrawalHash: WithdrawalHash(batchExits(witnesses), cmimc.NewMiMC()),
+		DataHash:       DataHash(BatchData(witnesses), cmimc.NewMiMC()),
+	}
+	for _, opts := range [][]Option{nil, {WithPublicCommitment()}} {
+		full, err := frontend.NewWitness(Assign(witnesses, pathLen, opts...), ecc.BN254.ScalarField())
+		if err != nil {
+			t.Fatalf("witness: %v", err)
+		}
+		want, err := full.Public()
+		if err != nil {
+			t.Fatalf("public part: %v", err)
+		}
+		public := PublicAssignment(p, opts...)
+		got, err := frontend.NewWitness(public, ecc.BN254.ScalarField(), frontend.PublicOnly())
+		if err != nil {
+			t.Fatalf("public witness: %v", err)
+		}
+		wb, _ := want.MarshalBinary()
+		gb, _ := got.MarshalBinary()
+		if !bytes.Equal(wb, gb) {
+			t.Fatalf("options %d: verifier public witness differs from the prover's", len(opts))
+		}
+	}
+}
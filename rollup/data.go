@@ -0,0 +1,301 @@
+package rollup
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// Errors returned while encoding or decoding batch data.
+var (
+	ErrDataRange     = errors.New("rollup: value does not fit the batch data encoding")
+	ErrMalformedData = errors.New("rollup: malformed batch data")
+)
+
+// TxData is the published, signature-free form of one batch slot: what an
+// observer needs to replay the slot on its own copy of the state. Fields a slot
+// type does not use are zero:
+//
+//	type           token  sender  receiver  nonce  amount  fee  pubKey
+//	TxTransfer       x      x        x        x      x      x
+//	TxNoop
+//	TxDeposit        x               x               x             x
+//	TxWithdrawal     x      x                 x      x
+//	TxCreate                         x                             x
+//	TxCollectFees                    x               x
+//
+// Sender and Receiver are account indices; PubKey is the key a deposit or a
+// registration installs.
+type TxData struct {
+	Type     TxType
+	TokenID  uint64
+	Sender   Index
+	Receiver Index
+	Nonce    uint64
+	Amount   fr.Element
+	Fee      fr.Element
+	PubKey   eddsa.PublicKey
+}
+
+// uses reports which optional fields slots of type t carry, in TxData order.
+func (t TxType) uses() (token, sender, receiver, nonce, amount, fee, pubKey bool) {
+	switch t {
+	case TxTransfer:
+		return true, true, true, true, true, true, false
+	case TxDeposit:
+		return true, false, true, false, true, false, true
+	case TxWithdrawal:
+		return true, true, false, true, true, false, false
+	case TxCreate:
+		return false, false, true, false, false, false, true
+	case TxCollectFees:
+		return false, false, true, false, true, false, false
+	}
+	return false, false, false, false, false, false, false
+}
+
+// BatchData returns the published data of a batch of witnesses, one TxData per
+// slot.
+func BatchData(witnesses []TransferWitness) []TxData {
+	txs := make([]TxData, len(witnesses))
+	for i := range witnesses {
+		w := &witnesses[i]
+		token, sender, receiver, nonce, amount, fee, pubKey := w.Type.uses()
+		tx := TxData{Type: w.Type}
+		if token {
+			tx.TokenID = w.TokenID
+		}
+		if sender {
+			tx.Sender = w.SenderBefore.Index
+		}
+		if receiver {
+			tx.Receiver = w.ReceiverBefore.Index
+		}
+		if nonce {
+			tx.Nonce = w.SenderBefore.Nonce
+		}
+		if amount {
+			tx.Amount = w.Amount
+		}
+		if fee {
+			tx.Fee = w.Fee
+		}
+		if pubKey {
+			tx.PubKey = w.ReceiverAfter.PubKey
+		}
+		txs[i] = tx
+	}
+	return txs
+}
+
+// EncodeBatch returns the canonical byte encoding of a batch's data: the
+// concatenation of one record per slot. A record is the type byte followed by
+// the fields the type uses, in TxData order: the token id as 1 byte, account
+// indices as 20 bytes, nonce, amount and fee as 8 bytes (all big-endian), and a
+// public key in its 32-byte compressed form. Signatures are not published; the
+// batch proof stands in for them.
+func EncodeBatch(txs []TxData) ([]byte, error) {
+	var b []byte
+	for i := range txs {
+		tx := &txs[i]
+		if tx.Type > TxCollectFees {
+			return nil, ErrMalformedData
+		}
+		b = append(b, byte(tx.Type))
+		token, sender, receiver, nonce, amount, fee, pubKey := tx.Type.uses()
+		if token {
+			if tx.TokenID >= NbTokens {
+				return nil, ErrDataRange
+			}
+			b = append(b, byte(tx.TokenID))
+		}
+		if sender {
+			b = append(b, tx.Sender[:]...)
+		}
+		if receiver {
+			b = append(b, tx.Receiver[:]...)
+		}
+		if nonce {
+			b = binary.BigEndian.AppendUint64(b, tx.Nonce)
+		}
+		for _, v := range []struct {
+			used bool
+			e    *fr.Element
+		}{{amount, &tx.Amount}, {fee, &tx.Fee}} {
+			if !v.used {
+				continue
+			}
+			if !v.e.IsUint64() {
+				return nil, ErrDataRange
+			}
+			b = binary.BigEndian.AppendUint64(b, v.e.Uint64())
+		}
+		if pubKey {
+			b = append(b, tx.PubKey.Bytes()...)
+		}
+	}
+	return b, nil
+}
+
+// DecodeBatch parses the output of EncodeBatch back into the batch's data.
+func DecodeBatch(b []byte) ([]TxData, error) {
+	var txs []TxData
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, ErrMalformedData
+		}
+		chunk := b[:n]
+		b = b[n:]
+		return chunk, nil
+	}
+	for len(b) > 0 {
+		typ, _ := next(1)
+		tx := TxData{Type: TxType(typ[0])}
+		if tx.Type > TxCollectFees {
+			return nil, ErrMalformedData
+		}
+
+		token, sender, receiver, nonce, amount, fee, pubKey := tx.Type.uses()
+		if token {
+			c, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			if tx.TokenID = uint64(c[0]); tx.TokenID >= NbTokens {
+				return nil, ErrMalformedData
+			}
+		}
+		for _, v := range []struct {
+			used bool
+			dst  *Index
+		}{{sender, &tx.Sender}, {receiver, &tx.Receiver}} {
+			if !v.used {
+				continue
+			}
+			c, err := next(len(v.dst))
+			if err != nil {
+				return nil, err
+			}
+			copy(v.dst[:], c)
+		}
+		for _, v := range []struct {
+			used bool
+			dst  func(uint64)
+		}{
+			{nonce, func(x uint64) { tx.Nonce = x }},
+			{amount, func(x uint64) { tx.Amount.SetUint64(x) }},
+			{fee, func(x uint64) { tx.Fee.SetUint64(x) }},
+		} {
+			if !v.used {
+				continue
+			}
+			c, err := next(8)
+			if err != nil {
+				return nil, err
+			}
+			v.dst(binary.BigEndian.Uint64(c))
+		}
+		if pubKey {
+			c, err := next(32)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := tx.PubKey.SetBytes(c); err != nil {
+				return nil, ErrMalformedData
+			}
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+// DataHash chains a batch's data, in slot order, into the data commitment
+// exposed by Circuit.DataHash:
+//
+//	c_0 = 0, c_k = H(c_{k-1} || type || tokenID || sender || receiver ||
+//	                    nonce || amount || fee || pubKeyX || pubKeyY)
+//
+// with the fields a slot type does not use set to zero. An observer recomputes
+// it over the decoded published data to check it is the data the proof covers.
+// The hasher is reset before use.
+func DataHash(txs []TxData, h hash.Hash) []byte {
+	var acc fr.Element
+	for i := range txs {
+		tx := &txs[i]
+		var typ, token, nonce fr.Element
+		typ.SetUint64(uint64(tx.Type))
+		token.SetUint64(tx.TokenID)
+		nonce.SetUint64(tx.Nonce)
+		acc = hashElements(h, acc, typ, token, tx.Sender.element(), tx.Receiver.element(), nonce, tx.Amount, tx.Fee, tx.PubKey.A.X, tx.PubKey.A.Y)
+	}
+	b := acc.Bytes()
+	return b[:]
+}
+
+// Replay applies published batch data to the operator's state without any
+// validation beyond type and token bounds: the batch proof already attests
+// that the data is a valid transition. An unknown slot type fails with
+// ErrMalformedData and a token id that is not below NbTokens with
+// ErrInvalidToken, both before anything is applied. An observer that starts
+// from the genesis state and replays every proven batch in order reconstructs
+// every account and the state root.
+func (o *Operator) Replay(txs []TxData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range txs {
+		if err := o.checkTxData(&txs[i]); err != nil {
+			return err
+		}
+	}
+	for i := range txs {
+		tx := &txs[i]
+		switch tx.Type {
+		case TxNoop:
+		case TxTransfer:
+			sender := o.readAccount(tx.Sender)
+			sender.Nonce++
+			sender.Balances[tx.TokenID].Sub(&sender.Balances[tx.TokenID], &tx.Amount)
+			sender.Balances[FeeToken].Sub(&sender.Balances[FeeToken], &tx.Fee)
+			o.writeAccount(sender)
+			o.pendingFees.Add(&o.pendingFees, &tx.Fee)
+
+			receiver := o.readAccount(tx.Receiver)
+			receiver.Balances[tx.TokenID].Add(&receiver.Balances[tx.TokenID], &tx.Amount)
+			o.writeAccount(receiver)
+		case TxDeposit, TxCreate:
+			acc := o.readAccount(tx.Receiver)
+			acc.PubKey = tx.PubKey
+			acc.Balances[tx.TokenID].Add(&acc.Balances[tx.TokenID], &tx.Amount)
+			o.indexKey(tx.PubKey, tx.Receiver)
+			o.writeAccount(acc)
+		case TxWithdrawal:
+			acc := o.readAccount(tx.Sender)
+			acc.Nonce++
+			acc.Balances[tx.TokenID].Sub(&acc.Balances[tx.TokenID], &tx.Amount)
+			o.writeAccount(acc)
+		case TxCollectFees:
+			acc := o.readAccount(tx.Receiver)
+			acc.Balances[FeeToken].Add(&acc.Balances[FeeToken], &tx.Amount)
+			o.writeAccount(acc)
+			o.pendingFees.SetZero()
+		default:
+			return ErrMalformedData
+		}
+	}
+	return nil
+}
+
+// checkTxData returns the error Replay fails with for tx, if any, so a batch is
+// rejected before any of its slots is applied.
+func (o *Operator) checkTxData(tx *TxData) error {
+	if tx.Type > TxCollectFees {
+		return ErrMalformedData
+	}
+	if tx.TokenID >= NbTokens {
+		return ErrInvalidToken
+	}
+	return nil
+}
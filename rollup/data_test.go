@@ -0,0 +1,157 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math/rand"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	"github.com/consensys/gnark/test"
+)
+
+// newGenesis builds a deterministic genesis state: accounts 0..3 with balance
+// 50+i.
+func newGenesis(t *testing.T) (*Operator, []eddsa.PrivateKey) {
+	t.Helper()
+	r := rand.New(rand.NewSource(31)) //#nosec G404 -- deterministic test
+	return addAccounts(t, NewOperator(cmimc.NewMiMC()), 4, 50, r)
+}
+
+// buildMixedBatch applies one slot of every type on a genesis operator and pads
+// the batch to 8 slots (settling the fee on the way).
+func buildMixedBatch(t *testing.T, op *Operator, privs []eddsa.PrivateKey) []TransferWitness {
+	t.Helper()
+	acc0 := accountOf(t, op, privs[0])
+	acc1 := accountOf(t, op, privs[1])
+	newPub, _ := newKey(t, 32)
+	regPub, _ := newKey(t, 33)
+
+	transfer := NewTransferWithFee(7, 2, acc0.PubKey, acc1.PubKey, acc0.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign transfer: %v", err)
+	}
+	tw, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	d := NewDeposit(30, newPub)
+	d.TokenID = 3
+	dw, err := op.ApplyDeposit(d)
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	cw, err := op.CreateAccount(regPub)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	wd := NewWithdrawal(5, acc1.PubKey, testRecipient, acc1.Nonce)
+	if _, err := wd.Sign(privs[1], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign withdrawal: %v", err)
+	}
+	ww, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	witnesses, err := op.PadBatch([]TransferWitness{tw, dw, cw, ww}, 8)
+	if err != nil {
+		t.Fatalf("pad: %v", err)
+	}
+	return witnesses
+}
+
+func TestReplayReconstructsState(t *testing.T) {
+	op, privs := newGenesis(t)
+	observer, _ := newGenesis(t)
+	witnesses := buildMixedBatch(t, op, privs)
+
+	published, err := EncodeBatch(BatchData(witnesses))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	txs, err := DecodeBatch(published)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, want := DataHash(txs, cmimc.NewMiMC()), BatchPublicData(witnesses).DataHash; !bytes.Equal(got, want) {
+		t.Fatal("decoded data does not hash to the committed data hash")
+	}
+	if err := observer.Replay(txs); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	root, _ := op.Root()
+	if got, _ := observer.Root(); !bytes.Equal(got, root) {
+		t.Fatal("replayed state root differs from the operator's")
+	}
+	if !maps.Equal(observer.accounts, op.accounts) {
+		t.Fatal("replayed accounts differ from the operator's")
+	}
+}
+
+func TestCircuitSolvesMixedBatchData(t *testing.T) {
+	op, privs := newGenesis(t)
+	witnesses := buildMixedBatch(t, op, privs)
+	pathLen := len(witnesses[0].SenderProof.Path)
+	circuit := New(len(witnesses), pathLen)
+
+	assignment := Assign(witnesses, pathLen)
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatalf("circuit should solve a batch with every slot type: %v", err)
+	}
+
+	// publishing a different amount than the one applied must not verify
+	txs := BatchData(witnesses)
+	txs[0].Amount.SetUint64(8)
+	assignment.PublicInputs[4] = DataHash(txs, cmimc.NewMiMC())
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("circuit accepted a data hash over other transaction data")
+	}
+}
+
+func TestDecodeBatchRejectsMalformed(t *testing.T) {
+	op, privs := newGenesis(t)
+	published, err := EncodeBatch(BatchData(buildMixedBatch(t, op, privs)))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	for name, b := range map[string][]byte{
+		"truncated":    published[:3],
+		"unknown type": append(append([]byte{}, published...), 0xff),
+	} {
+		if _, err := DecodeBatch(b); err != ErrMalformedData {
+			t.Fatalf("%s: expected ErrMalformedData, got %v", name, err)
+		}
+	}
+}
+
+func TestReplayRejectsInvalidData(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		spoil func(tx *TxData)
+		want  error
+	}{
+		{"token", func(tx *TxData) { tx.TokenID = NbTokens }, ErrInvalidToken},
+		{"type", func(tx *TxData) { tx.Type = TxCollectFees + 1 }, ErrMalformedData},
+	} {
+		op, privs := newGenesis(t)
+		observer, _ := newGenesis(t)
+		txs := BatchData(buildMixedBatch(t, op, privs))
+		// the earlier slots write accounts and the pending fees if applied
+		last := &txs[len(txs)-1]
+		last.Type = TxTransfer
+		tc.spoil(last)
+		root, _ := observer.Root()
+		fees := observer.pendingFees
+
+		if err := observer.Replay(txs); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		if got, _ := observer.Root(); !bytes.Equal(got, root) || !observer.pendingFees.Equal(&fees) {
+			t.Fatalf("%s: a rejected replay changed the state", tc.name)
+		}
+	}
+}
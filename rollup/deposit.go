@@ -0,0 +1,43 @@
+package rollup
+
+import (
+	"hash"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// Deposit moves value from L1 into the rollup: it credits Amount of token
+// TokenID to the account owned by PubKey, creating that account in an empty
+// slot if needed. Deposits are authorized by the L1 bridge, not by an L2
+// signature.
+type Deposit struct {
+	PubKey  eddsa.PublicKey
+	TokenID uint64
+	Amount  fr.Element
+}
+
+// NewDeposit creates a deposit of amount of FeeToken to the owner of to. Set
+// TokenID to deposit another token.
+func NewDeposit(amount uint64, to eddsa.PublicKey) Deposit {
+	var d Deposit
+	d.Amount.SetUint64(amount)
+	d.PubKey = to
+	return d
+}
+
+// DepositHash chains a batch's deposits, in order, into the deposit-queue
+// commitment exposed by Circuit.DepositHash:
+//
+//	d_0 = 0, d_k = H(d_{k-1} || pubKeyX || pubKeyY || tokenID || amount)
+//
+// An L1 bridge recomputes it over the deposits it expects the batch to consume.
+// The hasher is reset before use.
+func DepositHash(deposits []Deposit, h hash.Hash) []byte {
+	var acc fr.Element
+	for _, d := range deposits {
+		acc = hashElements(h, acc, d.PubKey.A.X, d.PubKey.A.Y, toElem(d.TokenID), d.Amount)
+	}
+	b := acc.Bytes()
+	return b[:]
+}
@@ -0,0 +1,113 @@
+package rollup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// newKey returns a fresh deterministic key pair that has no account yet.
+func newKey(t *testing.T, seed int64) (eddsa.PublicKey, eddsa.PrivateKey) {
+	t.Helper()
+	r := rand.New(rand.NewSource(seed)) //#nosec G404 -- deterministic test
+	priv, err := eddsa.GenerateKey(r)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	return priv.PublicKey, *priv
+}
+
+// occupyLeaf writes an account of a fresh key into the leaf at pub's index, as
+// a key whose hash matched pub's on StateDepth bits would hold it. No such key
+// can be found to test with.
+func occupyLeaf(t *testing.T, op *Operator, pub eddsa.PublicKey) {
+	t.Helper()
+	squatter, _ := newKey(t, 1<<20)
+	acc := emptyAccount(KeyIndex(pub, op.h))
+	acc.PubKey = squatter
+	op.indexKey(squatter, acc.Index)
+	op.writeAccount(acc)
+}
+
+func TestApplyDepositCreatesAccount(t *testing.T) {
+	op := NewOperator(cmimc.NewMiMC())
+	pub, _ := newKey(t, 1)
+
+	w, err := op.ApplyDeposit(NewDeposit(30, pub))
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	if !w.ReceiverBefore.IsEmpty() || w.ReceiverAfter.Index != KeyIndex(pub, cmimc.NewMiMC()) {
+		t.Fatal("deposit to a new key must fill the empty leaf at the key's index")
+	}
+	acc := op.ReadAccount(w.ReceiverAfter.Index)
+	want := newElem(30)
+	if !acc.Balances[FeeToken].Equal(&want) || !acc.PubKey.A.Equal(&pub.A) || acc.Nonce != 0 {
+		t.Fatal("created account does not hold the deposit")
+	}
+	if root, _ := op.Root(); !bytes.Equal(root, w.RootAfter) {
+		t.Fatal("witness RootAfter does not match the operator root")
+	}
+}
+
+func TestApplyDepositCreditsExistingAccount(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	acc := accountOf(t, op, privs[5]) // balance 25
+
+	w, err := op.ApplyDeposit(NewDeposit(10, acc.PubKey))
+	if err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	if w.ReceiverAfter.Index != acc.Index {
+		t.Fatalf("deposit credited leaf %d, want %d", w.ReceiverAfter.Index, acc.Index)
+	}
+	got := accountOf(t, op, privs[5])
+	want := newElem(35)
+	if !got.Balances[FeeToken].Equal(&want) {
+		t.Fatal("existing account was not credited")
+	}
+}
+
+func TestApplyDepositRejects(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	var empty Account
+	empty.Reset()
+	if _, err := op.ApplyDeposit(NewDeposit(1, empty.PubKey)); err != ErrEmptyPubKey {
+		t.Fatalf("identity key: expected ErrEmptyPubKey, got %v", err)
+	}
+
+	acc := accountOf(t, op, privs[0])
+	if _, err := op.ApplyDeposit(NewDeposit(^uint64(0), acc.PubKey)); err != ErrBalanceOverflow {
+		t.Fatalf("overflowing credit: expected ErrBalanceOverflow, got %v", err)
+	}
+
+	// a new key whose leaf holds another account cannot be created
+	pub, _ := newKey(t, 5)
+	occupyLeaf(t, op, pub)
+	index := KeyIndex(pub, op.h)
+	held := op.ReadAccount(index)
+	if _, err := op.ApplyDeposit(NewDeposit(1, pub)); err != ErrKeyMismatch {
+		t.Fatalf("taken leaf: expected ErrKeyMismatch, got %v", err)
+	}
+	if got := op.ReadAccount(index); !got.PubKey.A.Equal(&held.PubKey.A) {
+		t.Fatal("a rejected deposit changed the account's key")
+	}
+}
+
+func TestDepositHashChains(t *testing.T) {
+	a, _ := newKey(t, 3)
+	b, _ := newKey(t, 4)
+	h := cmimc.NewMiMC()
+
+	if got := DepositHash(nil, h); !bytes.Equal(got, make([]byte, 32)) {
+		t.Fatal("a batch without deposits must commit to zero")
+	}
+	ab := DepositHash([]Deposit{NewDeposit(1, a), NewDeposit(2, b)}, h)
+	ba := DepositHash([]Deposit{NewDeposit(2, b), NewDeposit(1, a)}, h)
+	if bytes.Equal(ab, ba) {
+		t.Fatal("deposit hash must depend on the deposit order")
+	}
+}
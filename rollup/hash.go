@@ -0,0 +1,80 @@
+package rollup
+
+import (
+	"errors"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	cposeidon2 "github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon2"
+	chash "github.com/consensys/gnark-crypto/hash"
+	"github.com/consensys/gnark/frontend"
+	ghash "github.com/consensys/gnark/std/hash"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/hash/poseidon2"
+)
+
+// ErrUnknownHashSuite is returned for a HashSuite other than MiMC and Poseidon2.
+var ErrUnknownHashSuite = errors.New("rollup: unknown hash suite")
+
+// HashSuite selects the hash function H of a rollup instance. H commits account
+// leaves, compresses the nodes of the token subtrees and of the account tree
+// (see compress), hashes the signed transfer and withdrawal messages (and the
+// signature challenge), and chains the deposit, withdrawal and data hashes.
+// The operator, the signers and the circuit must all use the same suite: the
+// operator and signers through New, the circuit through WithHashSuite.
+type HashSuite uint8
+
+// Hash suites. Both hash BN254 scalar field elements, one 32-byte big-endian
+// block per element.
+const (
+	// MiMC is the default suite: MiMC over the BN254 scalar field.
+	MiMC HashSuite = iota
+	// Poseidon2 is Poseidon2 over the BN254 scalar field in Merkle-Damgård
+	// mode. It costs about a third fewer R1CS constraints than MiMC.
+	Poseidon2
+)
+
+// String returns the suite's name.
+func (s HashSuite) String() string {
+	switch s {
+	case MiMC:
+		return "MiMC"
+	case Poseidon2:
+		return "Poseidon2"
+	}
+	return "unknown"
+}
+
+// New returns a native hasher for the suite, for NewOperator, signing and the
+// native hash chains. It panics on an unknown suite.
+func (s HashSuite) New() chash.StateStorer {
+	switch s {
+	case MiMC:
+		return cmimc.NewMiMC()
+	case Poseidon2:
+		return cposeidon2.NewMerkleDamgardHasher()
+	}
+	panic(ErrUnknownHashSuite)
+}
+
+// circuitHasher returns the in-circuit counterpart of New.
+func (s HashSuite) circuitHasher(api frontend.API) (ghash.StateStorer, error) {
+	switch s {
+	case MiMC:
+		h, err := mimc.NewMiMC(api)
+		if err != nil {
+			return nil, err
+		}
+		return &h, nil
+	case Poseidon2:
+		return poseidon2.New(api)
+	}
+	return nil, ErrUnknownHashSuite
+}
+
+// WithHashSuite selects the circuit's hash suite (default MiMC). It must match
+// the suite of the operator that produced the witnesses.
+func WithHashSuite(s HashSuite) Option {
+	return func(c *Circuit) {
+		c.hash = s
+	}
+}
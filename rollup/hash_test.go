@@ -0,0 +1,52 @@
+package rollup
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/test"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
+)
+
+// buildSuiteBatch applies one signed transfer on a 16-account operator hashing
+// with s.
+func buildSuiteBatch(t *testing.T, s HashSuite) ([]TransferWitness, int) {
+	t.Helper()
+	op, privs := newBatchOperator(t, 16, WithHashSuite(s))
+	acc0 := accountOf(t, op, privs[0])
+	acc1 := accountOf(t, op, privs[1])
+
+	transfer := NewTransfer(5, acc0.PubKey, acc1.PubKey, acc0.Nonce)
+	if _, err := transfer.Sign(privs[0], s.New()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, err := transfer.Verify(s.New()); err != nil || !ok {
+		t.Fatalf("verify signature: %v", err)
+	}
+	w, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	return []TransferWitness{w}, len(w.SenderProof.Path)
+}
+
+func TestHashSuitesProveVerify(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping Groth16 proving in -short mode")
+	}
+	for _, s := range []HashSuite{MiMC, Poseidon2} {
+		witnesses, pathLen := buildSuiteBatch(t, s)
+		circuit := New(len(witnesses), pathLen, WithHashSuite(s))
+		if err := prove.Run(circuit, Assign(witnesses, pathLen, WithHashSuite(s))); err != nil {
+			t.Fatalf("%s: expected the batch to prove and verify: %v", s, err)
+		}
+	}
+}
+
+func TestCircuitRejectsOtherHashSuite(t *testing.T) {
+	witnesses, pathLen := buildSuiteBatch(t, Poseidon2)
+	circuit := New(len(witnesses), pathLen)
+	if err := test.IsSolved(circuit, Assign(witnesses, pathLen), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("a MiMC circuit accepted a state hashed with Poseidon2")
+	}
+}
@@ -0,0 +1,199 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrUnknownRoot is returned by AccountAt and ProofAt for a root that is not
+// among the retained versions.
+var ErrUnknownRoot = errors.New("rollup: root is not in the retained state history")
+
+// history keeps the recent versions of an operator's state, so accounts and
+// proofs can be read against a root the operator has since moved past.
+//
+// A version is the state at a batch boundary: the state a batch ended on,
+// whose root a batch proof exposes as NewRoot. Versions are cut when the batch
+// number changes (see Operator.SetBatchNumber), and only if the root moved
+// since the last one. Rather than a copy of the state, each version stores the
+// values that the writes after it overwrote (accounts, leaves and tree nodes,
+// the first time each is overwritten). A value of version k is thus found in
+// the first of versions k, k+1, ... that recorded it, or in the current state.
+type history struct {
+	retain   int        // number of versions kept
+	versions []*version // oldest first; writes record into the last
+}
+
+// version is the state under root, by what changed after it.
+type version struct {
+	root     []byte
+	accounts map[Index]Account
+	nodes    map[nodeKey][]byte // the leaves are the nodes of level 0
+}
+
+// nodeKey addresses a node of the merkleTree.
+type nodeKey struct {
+	level int
+	pos   Index
+}
+
+func newVersion(root []byte) *version {
+	return &version{
+		root:     root,
+		accounts: make(map[Index]Account),
+		nodes:    make(map[nodeKey][]byte),
+	}
+}
+
+// SetHistoryRetention makes the operator keep its last n state versions, each
+// one the state at the end of a batch, so that AccountAt and ProofAt can serve
+// any of their roots. A batch ends when SetBatchNumber moves to another
+// number; the state when the history is enabled is the first version. The
+// current state is always served as well, including partway through a batch.
+// Each version costs memory in proportion to the accounts its successor wrote.
+// Calling it again changes the retention, dropping the oldest versions if
+// needed; n < 1 disables the history. The history is not persisted by Store.
+func (o *Operator) SetHistoryRetention(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n < 1 {
+		o.history = nil
+		return
+	}
+	if o.history == nil {
+		o.history = &history{versions: []*version{newVersion(o.tree.root())}}
+	}
+	o.history.retain = n
+	o.history.prune()
+}
+
+// AccountAt returns the account stored at index i in the state whose root is
+// root, which must be the current root or the root of a retained batch (see
+// SetHistoryRetention).
+func (o *Operator) AccountAt(root []byte, i Index) (Account, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	v, err := o.versionOf(root)
+	if err != nil {
+		return Account{}, err
+	}
+	if a, ok := o.history.account(v, i); ok {
+		return a, nil
+	}
+	return o.readAccount(i), nil
+}
+
+// ProofAt returns the Merkle inclusion proof of the account at index i against
+// root, which must be the current root or the root of a retained batch (see
+// SetHistoryRetention).
+func (o *Operator) ProofAt(root []byte, i Index) (MerkleProofData, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	v, err := o.versionOf(root)
+	if err != nil {
+		return MerkleProofData{}, err
+	}
+	path := [][]byte{o.nodeAt(v, nodeKey{0, i})}
+	pos := i
+	for l := 0; l < o.tree.depth(); l++ {
+		path = append(path, o.nodeAt(v, nodeKey{l, pos.sibling()}))
+		pos = pos.parent()
+	}
+	return MerkleProofData{RootHash: append([]byte(nil), root...), Path: path, Index: i}, nil
+}
+
+// nodeAt returns the tree node k as of version v.
+func (o *Operator) nodeAt(v int, k nodeKey) []byte {
+	if n, ok := o.history.node(v, k); ok {
+		return n
+	}
+	return o.tree.node(k.level, k.pos)
+}
+
+// versionOf returns the position in the history of the most recent version
+// with the given root, or the number of versions for the current root, which
+// needs no overwritten values.
+func (o *Operator) versionOf(root []byte) (int, error) {
+	if o.history == nil {
+		if bytes.Equal(root, o.tree.root()) {
+			return 0, nil
+		}
+		return 0, ErrUnknownRoot
+	}
+	if bytes.Equal(root, o.tree.root()) {
+		return len(o.history.versions), nil
+	}
+	for v := len(o.history.versions) - 1; v >= 0; v-- {
+		if bytes.Equal(o.history.versions[v].root, root) {
+			return v, nil
+		}
+	}
+	return 0, ErrUnknownRoot
+}
+
+// account returns account i as of version v if it was overwritten since.
+func (h *history) account(v int, i Index) (Account, bool) {
+	if h == nil {
+		return Account{}, false
+	}
+	for _, ver := range h.versions[v:] {
+		if a, ok := ver.accounts[i]; ok {
+			return a, true
+		}
+	}
+	return Account{}, false
+}
+
+// node returns the tree node k as of version v if it was overwritten since.
+func (h *history) node(v int, k nodeKey) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	for _, ver := range h.versions[v:] {
+		if n, ok := ver.nodes[k]; ok {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// recordWrite saves, in the current version, the account at index i with its
+// leaf and tree path as they are before a write overwrites them.
+func (o *Operator) recordWrite(i Index) {
+	if o.history == nil {
+		return
+	}
+	cur := o.history.versions[len(o.history.versions)-1]
+	if _, ok := cur.accounts[i]; !ok {
+		cur.accounts[i] = o.readAccount(i)
+	}
+	// tree updates replace nodes rather than write into them, so the old
+	// slices can be kept as they are
+	pos := i
+	for l := 0; l <= o.tree.depth(); l++ {
+		k := nodeKey{l, pos}
+		if _, ok := cur.nodes[k]; !ok {
+			cur.nodes[k] = o.tree.node(l, pos)
+		}
+		pos = pos.parent()
+	}
+}
+
+// cut ends a batch: the state under root becomes a new version if it differs
+// from the last one. Writes undone in between (a failed ApplyBatch) leave the
+// root, so they make no version.
+func (h *history) cut(root []byte) {
+	if h == nil || bytes.Equal(root, h.versions[len(h.versions)-1].root) {
+		return
+	}
+	h.versions = append(h.versions, newVersion(root))
+	h.prune()
+}
+
+// prune drops the versions beyond the retention, oldest first.
+func (h *history) prune() {
+	if n := len(h.versions) - h.retain; n > 0 {
+		clear(h.versions[:n])
+		h.versions = h.versions[n:]
+	}
+}
@@ -0,0 +1,108 @@
+package rollup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+)
+
+// stateAt is what an operator served for some accounts at one root.
+type stateAt struct {
+	root     []byte
+	accounts []Account
+	proofs   []MerkleProofData
+}
+
+// captureState reads accounts and proofs of the given indexes at the current
+// root.
+func captureState(t *testing.T, op *Operator, indexes []Index) stateAt {
+	t.Helper()
+	s := stateAt{}
+	s.root, _ = op.Root()
+	for _, i := range indexes {
+		s.accounts = append(s.accounts, op.ReadAccount(i))
+		s.proofs = append(s.proofs, op.Proof(i))
+	}
+	return s
+}
+
+// checkStateAt fails unless AccountAt and ProofAt at s.root serve s.
+func checkStateAt(t *testing.T, op *Operator, s stateAt, indexes []Index) {
+	t.Helper()
+	for k, i := range indexes {
+		acc, err := op.AccountAt(s.root, i)
+		if err != nil || !reflect.DeepEqual(acc, s.accounts[k]) {
+			t.Fatalf("AccountAt(%x, %s) = %v, %v", s.root[:4], i, acc, err)
+		}
+		p, err := op.ProofAt(s.root, i)
+		if err != nil || !reflect.DeepEqual(p, s.proofs[k]) {
+			t.Fatalf("ProofAt(%x, %s) differs from the proof served at that root: %v", s.root[:4], i, err)
+		}
+	}
+}
+
+func TestHistoryServesRetainedRoots(t *testing.T) {
+	op, privs := newBatchOperator(t, 7)
+	op.SetHistoryRetention(3)
+	// accounts 0, 1 and 5, and the empty leaf a deposit fills in batch 2
+	pub, _ := newKey(t, 23)
+	indexes := []Index{indexOf(t, op, privs[0]), indexOf(t, op, privs[1]), indexOf(t, op, privs[5]), KeyIndex(pub, cmimc.NewMiMC())}
+
+	states := []stateAt{captureState(t, op, indexes)}
+	op.SetBatchNumber(1)
+	applyTransfers(t, op, privs, 1)
+	states = append(states, captureState(t, op, indexes))
+
+	// a batch of two writes makes one version, at its end
+	op.SetBatchNumber(2)
+	if _, err := op.ApplyDeposit(NewDeposit(9, pub)); err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+	mid := captureState(t, op, indexes)
+	checkStateAt(t, op, mid, indexes) // the current state is served mid-batch
+	applyTransfers(t, op, privs, 1)
+	states = append(states, captureState(t, op, indexes))
+
+	op.SetBatchNumber(3)
+	applyTransfers(t, op, privs, 1)
+	states = append(states, captureState(t, op, indexes))
+
+	// a failed batch leaves the root, so it makes no version
+	op.SetBatchNumber(4)
+	transfers := signedTransfers(t, op, privs, 2)
+	transfers[1].Nonce = 9
+	if _, err := op.ApplyBatch(transfers); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	op.SetBatchNumber(5)
+
+	for _, s := range states[1:] {
+		checkStateAt(t, op, s, indexes)
+	}
+	if _, err := op.AccountAt(states[0].root, Index{}); !errors.Is(err, ErrUnknownRoot) {
+		t.Fatalf("expected ErrUnknownRoot for a batch past the retention, got %v", err)
+	}
+	if _, err := op.AccountAt(mid.root, Index{}); !errors.Is(err, ErrUnknownRoot) {
+		t.Fatalf("expected ErrUnknownRoot for a root inside a batch, got %v", err)
+	}
+
+	// shrinking the retention drops the oldest versions
+	op.SetHistoryRetention(1)
+	if _, err := op.ProofAt(states[2].root, Index{}); !errors.Is(err, ErrUnknownRoot) {
+		t.Fatalf("expected ErrUnknownRoot after shrinking the retention, got %v", err)
+	}
+	checkStateAt(t, op, states[3], indexes)
+}
+
+func TestHistoryDisabledServesCurrentRoot(t *testing.T) {
+	op, privs := newBatchOperator(t, 4)
+	before, _ := op.Root()
+	applyTransfers(t, op, privs, 1)
+	indexes := []Index{indexOf(t, op, privs[0]), indexOf(t, op, privs[1])}
+	checkStateAt(t, op, captureState(t, op, indexes), indexes)
+	if _, err := op.AccountAt(before, Index{}); !errors.Is(err, ErrUnknownRoot) {
+		t.Fatalf("expected ErrUnknownRoot without history, got %v", err)
+	}
+}
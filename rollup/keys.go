@@ -6,19 +6,20 @@ import (
 	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
 )
 
-// NewAccount creates an account at the given index with the given balance and a
-// freshly generated EdDSA key pair, returning the account and its private key.
+// NewAccount creates an account with the given FeeToken balance and a freshly
+// generated EdDSA key pair, returning the account and its private key. Its
+// Index is left zero: the position of an account follows from its key and the
+// depth of the state tree, and Operator.AddAccount sets it.
 // Randomness is taken from r; pass a seeded source for deterministic tests.
-func NewAccount(index int, balance uint64, r io.Reader) (Account, eddsa.PrivateKey, error) {
+func NewAccount(balance uint64, r io.Reader) (Account, eddsa.PrivateKey, error) {
 	priv, err := eddsa.GenerateKey(r)
 	if err != nil {
 		return Account{}, eddsa.PrivateKey{}, err
 	}
 
 	var a Account
-	a.Index = uint64(index)
 	a.Nonce = 0
-	a.Balance.SetUint64(balance)
+	a.Balances[FeeToken].SetUint64(balance)
 	a.PubKey = priv.PublicKey
 
 	return a, *priv, nil
@@ -0,0 +1,250 @@
+package rollup
+
+import (
+	"errors"
+	"hash"
+	"sort"
+	"sync"
+)
+
+// MempoolNonceWindow bounds how far ahead of its sender's nonce a queued
+// transfer may be.
+const MempoolNonceWindow = 64
+
+// Errors returned by Mempool.Add.
+var (
+	ErrStaleNonce  = errors.New("rollup: transfer nonce is below the sender's nonce")
+	ErrNonceTooFar = errors.New("rollup: transfer nonce is MempoolNonceWindow or more ahead of the sender's nonce")
+	ErrNonceTaken  = errors.New("rollup: a transfer with this nonce is already queued for the sender")
+)
+
+// Mempool collects signed transfers ahead of the batches that apply them. It
+// checks signatures and accounts on intake, queues transfers per sender by
+// nonce, so they may arrive in any order, and drops them once the sender's
+// nonce has moved past them or the operator's batch number past their
+// ValidUntil. Batch picks the transfers that can be applied next, and drops
+// those that block their sender's queue because they cannot apply.
+//
+// A Mempool is safe for concurrent use.
+type Mempool struct {
+	op *Operator
+	h  hash.Hash // checks signatures; guarded by mu
+
+	mu      sync.Mutex
+	senders map[string]*senderQueue // compressed pubKey bytes, as in Operator.accountMap
+	arrival uint64                  // number of transfers added so far
+}
+
+// senderQueue holds the transfers queued for one sender.
+type senderQueue struct {
+	index Index // the sender's account index
+	txs   map[uint64]queuedTransfer
+}
+
+// queuedTransfer is a transfer with its arrival order.
+type queuedTransfer struct {
+	t       Transfer
+	arrival uint64
+}
+
+// NewMempool returns an empty mempool feeding op. h verifies signatures
+// (HashSuite.New of the rollup's suite); it must not be op's own hasher.
+func NewMempool(op *Operator, h hash.Hash) *Mempool {
+	return &Mempool{op: op, h: h, senders: make(map[string]*senderQueue)}
+}
+
+// Add queues a signed transfer. It fails with ErrWrongDomain for a transfer
+// signed for another deployment than the operator's, with ErrWrongSignature
+// for one not signed by its sender under the operator's Authorizer, with
+// ErrSelfTransfer, with ErrTransferExpired, with ErrNonExistingAccount for
+// an unknown sender or receiver, and with ErrStaleNonce, ErrNonceTooFar or
+// ErrNonceTaken for a nonce that is used, too far ahead or already queued.
+// Balances are only checked when a batch is built.
+func (m *Mempool) Add(t Transfer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.Domain != m.op.Domain() {
+		return ErrWrongDomain
+	}
+	if ok, err := t.VerifyWith(m.op.Authorizer(), m.h); err != nil || !ok {
+		return ErrWrongSignature
+	}
+	key := accountKey(t.SenderPubKey)
+	if key == accountKey(t.ReceiverPubKey) {
+		return ErrSelfTransfer
+	}
+	if t.ValidUntil < m.op.BatchNumber() {
+		return ErrTransferExpired
+	}
+	index, ok := m.op.AccountIndex(t.SenderPubKey)
+	if !ok {
+		return ErrNonExistingAccount
+	}
+	if _, ok := m.op.AccountIndex(t.ReceiverPubKey); !ok {
+		return ErrNonExistingAccount
+	}
+	sender := m.op.ReadAccount(index)
+	switch {
+	case t.Nonce < sender.Nonce:
+		return ErrStaleNonce
+	case t.Nonce-sender.Nonce >= MempoolNonceWindow:
+		return ErrNonceTooFar
+	}
+
+	q, ok := m.senders[key]
+	if !ok {
+		q = &senderQueue{index: index, txs: make(map[uint64]queuedTransfer)}
+		m.senders[key] = q
+	}
+	if _, ok := q.txs[t.Nonce]; ok {
+		return ErrNonceTaken
+	}
+	q.txs[t.Nonce] = queuedTransfer{t: t, arrival: m.arrival}
+	m.arrival++
+	return nil
+}
+
+// Len returns the number of queued transfers.
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, q := range m.senders {
+		n += len(q.txs)
+	}
+	return n
+}
+
+// Evict drops the transfers whose nonce the sender's account has moved past,
+// typically because a batch applied them, and those whose ValidUntil is below
+// the operator's batch number, and returns how many it dropped.
+func (m *Mempool) Evict() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch := m.op.BatchNumber()
+	n := 0
+	_ = m.op.View(func(v StateView) error {
+		n = m.evict(v, batch)
+		return nil
+	})
+	return n
+}
+
+// evict is Evict under m.mu, reading nonces from v and expiring transfers by
+// batch.
+func (m *Mempool) evict(v StateView, batch uint64) int {
+	n := 0
+	for key, q := range m.senders {
+		sender := v.ReadAccount(q.index)
+		for nonce, qt := range q.txs {
+			if nonce < sender.Nonce || qt.t.ValidUntil < batch {
+				delete(q.txs, nonce)
+				n++
+			}
+		}
+		if len(q.txs) == 0 {
+			delete(m.senders, key)
+		}
+	}
+	return n
+}
+
+// Batch evicts stale transfers and returns the largest ordered list of up to
+// batchSize queued transfers that ApplyBatch would accept on the operator's
+// current state. Each sender's transfers are taken in nonce order from its
+// account nonce, stopping at a gap; senders take turns in the order their next
+// transfer arrived, so a transfer that lacks funds can still follow one that
+// credits its sender. A sender's next transfer that still cannot apply once no
+// other transfer can be added is dropped, as it would hold back the sender's
+// later transfers; the sender may queue another with its nonce. The operator's
+// state is left unchanged, and the returned transfers stay queued until
+// applied.
+func (m *Mempool) Batch(batchSize int) []Transfer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// a sequencer polls an empty pool often: skip the operator's locks
+	if len(m.senders) == 0 {
+		return nil
+	}
+
+	var queues [][]queuedTransfer
+	batch := m.op.BatchNumber()
+	_ = m.op.View(func(v StateView) error {
+		m.evict(v, batch)
+		for _, q := range m.senders {
+			sender := v.ReadAccount(q.index)
+			var run []queuedTransfer
+			for nonce := sender.Nonce; ; nonce++ {
+				qt, ok := q.txs[nonce]
+				if !ok {
+					break
+				}
+				run = append(run, qt)
+			}
+			if len(run) > 0 {
+				queues = append(queues, run)
+			}
+		}
+		return nil
+	})
+	if len(queues) == 0 {
+		return nil
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i][0].arrival < queues[j][0].arrival })
+
+	transfers := make([][]Transfer, len(queues))
+	for i, run := range queues {
+		for _, qt := range run {
+			transfers[i] = append(transfers[i], qt.t)
+		}
+	}
+	selected, stuck := m.op.selectTransfers(transfers, batchSize)
+	for _, t := range stuck {
+		key := accountKey(t.SenderPubKey)
+		delete(m.senders[key].txs, t.Nonce)
+		if len(m.senders[key].txs) == 0 {
+			delete(m.senders, key)
+		}
+	}
+	return selected
+}
+
+// selectTransfers applies, in turns across queues, the next transfer of each
+// queue that applies on top of the previous ones, until batchSize are taken or
+// a whole turn takes none, and returns them in the order taken. In the second
+// case it also returns the next transfer of each queue not taken to the end,
+// none of which applies on the state the batch ends on. It rolls every change
+// back before returning.
+func (o *Operator) selectTransfers(queues [][]Transfer, batchSize int) (batch, stuck []Transfer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.begin()
+	defer o.rollback()
+
+	next := make([]int, len(queues))
+	for progress := true; progress && len(batch) < batchSize; {
+		progress = false
+		stuck = stuck[:0]
+		for i, q := range queues {
+			if len(batch) == batchSize {
+				break
+			}
+			if next[i] == len(q) {
+				continue
+			}
+			// a failing transfer writes nothing, so the next one starts clean
+			if _, err := o.applyTransfer(q[next[i]]); err == nil {
+				batch = append(batch, q[next[i]])
+				next[i]++
+				progress = true
+			} else {
+				stuck = append(stuck, q[next[i]])
+			}
+		}
+	}
+	if len(batch) == batchSize {
+		// the batch is full: the others were not all tried on its final state
+		return batch, nil
+	}
+	return batch, stuck
+}
@@ -0,0 +1,199 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// signedTransfer signs a transfer of amount (fee 1) from account `from` to
+// account `to` with the given nonce.
+func signedTransfer(t *testing.T, op *Operator, privs []eddsa.PrivateKey, from, to, amount, nonce uint64) Transfer {
+	t.Helper()
+	sender := accountOf(t, op, privs[from])
+	receiver := accountOf(t, op, privs[to])
+	transfer := NewTransferWithFee(amount, 1, sender.PubKey, receiver.PubKey, nonce)
+	if _, err := transfer.Sign(privs[from], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return transfer
+}
+
+func TestMempoolOrdersByNonce(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	m := NewMempool(op, cmimc.NewMiMC())
+	for _, nonce := range []uint64{2, 0, 4, 1} {
+		if err := m.Add(signedTransfer(t, op, privs, 0, 1, 1, nonce)); err != nil {
+			t.Fatalf("add nonce %d: %v", nonce, err)
+		}
+	}
+	root, _ := op.Root()
+
+	batch := m.Batch(8)
+	if len(batch) != 3 {
+		t.Fatalf("batch holds %d transfers, want nonces 0..2 before the gap", len(batch))
+	}
+	for k, tr := range batch {
+		if tr.Nonce != uint64(k) {
+			t.Fatalf("transfer %d has nonce %d", k, tr.Nonce)
+		}
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, root) {
+		t.Fatal("building a batch changed the state")
+	}
+	if got := m.Batch(2); len(got) != 2 {
+		t.Fatalf("batch of size 2 holds %d transfers", len(got))
+	}
+
+	if _, err := op.ApplyBatch(batch); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if n := m.Evict(); n != 3 || m.Len() != 1 {
+		t.Fatalf("evicted %d, %d left; want 3 evicted and nonce 4 queued", n, m.Len())
+	}
+}
+
+func TestMempoolRejects(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	applyTransfers(t, op, privs, 2)
+	m := NewMempool(op, cmimc.NewMiMC())
+	if err := m.Add(signedTransfer(t, op, privs, 0, 1, 1, 2)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	forged := signedTransfer(t, op, privs, 0, 1, 1, 3)
+	forged.Amount.SetUint64(50)
+	stranger, strangerPriv := newKey(t, 41)
+	receiver := accountOf(t, op, privs[1])
+	unknown := NewTransfer(1, stranger, receiver.PubKey, 0)
+	if _, err := unknown.Sign(strangerPriv, cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sender := accountOf(t, op, privs[0])
+	toStranger := NewTransfer(1, sender.PubKey, stranger, 3)
+	if _, err := toStranger.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	mirrored := receiver.PubKey
+	mirrored.A.Y.Neg(&mirrored.A.Y)
+	toMirrored := NewTransfer(1, sender.PubKey, mirrored, 3)
+	if _, err := toMirrored.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	otherDomain := signedTransfer(t, op, privs, 0, 1, 1, 3)
+	otherDomain.Domain = Domain{ChainID: 1}
+	if _, err := otherDomain.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	otherScheme := signedTransfer(t, op, privs, 0, 1, 1, 3)
+	if _, err := otherScheme.SignWith(Schnorr{}, privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		transfer Transfer
+		want     error
+	}{
+		{"other domain", otherDomain, ErrWrongDomain},
+		{"other scheme", otherScheme, ErrWrongSignature},
+		{"bad signature", forged, ErrWrongSignature},
+		{"unknown sender", unknown, ErrNonExistingAccount},
+		{"unknown receiver", toStranger, ErrNonExistingAccount},
+		{"receiver key sharing X", toMirrored, ErrNonExistingAccount},
+		{"stale nonce", signedTransfer(t, op, privs, 0, 1, 1, 1), ErrStaleNonce},
+		{"too far", signedTransfer(t, op, privs, 0, 1, 1, 2+MempoolNonceWindow), ErrNonceTooFar},
+		{"taken", signedTransfer(t, op, privs, 0, 1, 2, 2), ErrNonceTaken},
+		{"self-transfer", signedTransfer(t, op, privs, 0, 0, 1, 3), ErrSelfTransfer},
+	} {
+		if err := m.Add(tc.transfer); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if m.Len() != 1 {
+		t.Fatalf("%d transfers queued, want 1", m.Len())
+	}
+}
+
+func TestMempoolExpires(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	m := NewMempool(op, cmimc.NewMiMC())
+	expiring := func(from, validUntil uint64) Transfer {
+		tr := signedTransfer(t, op, privs, from, 1, 1, 0)
+		tr.ValidUntil = validUntil
+		if _, err := tr.Sign(privs[from], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return tr
+	}
+	for from, validUntil := range map[uint64]uint64{0: 2, 2: 3} {
+		if err := m.Add(expiring(from, validUntil)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	op.SetBatchNumber(3)
+	if err := m.Add(expiring(3, 2)); !errors.Is(err, ErrTransferExpired) {
+		t.Fatalf("expected ErrTransferExpired, got %v", err)
+	}
+	if n := m.Evict(); n != 1 || m.Len() != 1 {
+		t.Fatalf("evicted %d, %d left; want the transfer valid until 2 evicted", n, m.Len())
+	}
+	if batch := m.Batch(8); len(batch) != 1 || batch[0].ValidUntil != 3 {
+		t.Fatal("expected the transfer valid until batch 3 to be selected")
+	}
+}
+
+func TestMempoolBatchIsMaximal(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	m := NewMempool(op, cmimc.NewMiMC())
+	// account 2 (balance 102) cannot send 150 until account 3 credits it,
+	// although its transfer arrived first
+	for _, tr := range []Transfer{
+		signedTransfer(t, op, privs, 2, 0, 150, 0),
+		signedTransfer(t, op, privs, 3, 2, 60, 0),
+		signedTransfer(t, op, privs, 4, 0, 500, 0), // never funded
+		signedTransfer(t, op, privs, 4, 0, 1, 1),   // held back by nonce 0
+	} {
+		if err := m.Add(tr); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	batch := m.Batch(8)
+	if len(batch) != 2 || batch[0].Amount.Uint64() != 60 || batch[1].Amount.Uint64() != 150 {
+		t.Fatalf("expected the credit then the funded transfer, got %d transfers", len(batch))
+	}
+	// the unfunded transfer is dropped, so it no longer blocks nonce 1
+	if m.Len() != 3 {
+		t.Fatalf("%d transfers queued, want the unfunded one dropped", m.Len())
+	}
+	if _, err := op.ApplyBatch(batch); err != nil {
+		t.Fatalf("the selected batch does not apply: %v", err)
+	}
+	m.Evict()
+	if err := m.Add(signedTransfer(t, op, privs, 4, 0, 2, 0)); err != nil {
+		t.Fatalf("requeue nonce 0: %v", err)
+	}
+	if batch := m.Batch(8); len(batch) != 2 || batch[0].Nonce != 0 || batch[1].Nonce != 1 {
+		t.Fatalf("expected the requeued transfer then nonce 1, got %d transfers", len(batch))
+	}
+}
+
+func TestMempoolKeepsUntriedTransfersOfAFullBatch(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	m := NewMempool(op, cmimc.NewMiMC())
+	for _, tr := range []Transfer{
+		signedTransfer(t, op, privs, 3, 2, 60, 0),
+		signedTransfer(t, op, privs, 2, 0, 150, 0), // funded by the first
+	} {
+		if err := m.Add(tr); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if batch := m.Batch(1); len(batch) != 1 || m.Len() != 2 {
+		t.Fatalf("batch of %d, %d queued; want 1 taken and nothing dropped", len(batch), m.Len())
+	}
+}
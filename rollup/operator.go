@@ -1,12 +1,12 @@
 package rollup
 
 import (
-	"bytes"
 	"errors"
-	"hash"
+	"sync"
 
-	"github.com/consensys/gnark-crypto/accumulator/merkletree"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+	chash "github.com/consensys/gnark-crypto/hash"
 )
 
 // Errors returned while applying a transfer.
@@ -14,6 +14,13 @@ var (
 	ErrNonExistingAccount = errors.New("rollup: account is not in the state")
 	ErrAmountTooHigh      = errors.New("rollup: transfer amount exceeds sender balance")
 	ErrNonce              = errors.New("rollup: transfer nonce does not match sender nonce")
+	ErrBalanceOverflow    = errors.New("rollup: balance or amount would reach 2^BalanceBits")
+	ErrBatchTooLarge      = errors.New("rollup: batch holds more transactions than the batch size")
+	ErrEmptyPubKey        = errors.New("rollup: public key is the empty-account key")
+	ErrAccountExists      = errors.New("rollup: public key already has an account")
+	ErrInvalidToken       = errors.New("rollup: token id is not below NbTokens")
+	ErrSelfTransfer       = errors.New("rollup: transfer sender and receiver are the same account")
+	ErrKeyMismatch        = errors.New("rollup: the leaf at the public key's index holds another account")
 )
 
 // MerkleProofData is a native Merkle inclusion proof for one leaf. Path[0] is the
@@ -22,14 +29,27 @@ var (
 type MerkleProofData struct {
 	RootHash []byte
 	Path     [][]byte
-	Index    uint64
+	Index    Index
 }
 
 // TransferWitness is everything the circuit needs to verify one applied
 // transfer: the state roots before and after, both parties' account snapshots
-// and inclusion proofs in each state, and the transfer itself (amount, parsed
-// public keys, raw signature). The circuit's Assign consumes this directly.
+// before and after, one Merkle path per party, and the transfer itself (amount,
+// parsed public keys, raw signature). The circuit's Assign consumes this
+// directly.
+//
+// The slot writes the sender's leaf, then the receiver's: SenderProof is the
+// sender's proof in the RootBefore tree and ReceiverProof the receiver's proof
+// in the tree the sender write produced, whose root leads to RootAfter. A slot
+// that writes a single leaf makes the other side an identity update (equal
+// before and after accounts) at the point of the sequence it occupies.
+//
+// Type tells the circuit which rules apply to the slot; a TxNoop witness has
+// equal roots, unchanged accounts, a zero amount and no signature.
 type TransferWitness struct {
+	Type        TxType
+	BatchNumber uint64 // the batch the slot is applied in, see Operator.SetBatchNumber
+
 	RootBefore []byte
 	RootAfter  []byte
 
@@ -38,160 +58,570 @@ type TransferWitness struct {
 	ReceiverBefore Account
 	ReceiverAfter  Account
 
-	SenderProofBefore   MerkleProofData
-	SenderProofAfter    MerkleProofData
-	ReceiverProofBefore MerkleProofData
-	ReceiverProofAfter  MerkleProofData
+	SenderProof   MerkleProofData
+	ReceiverProof MerkleProofData
 
+	TokenID           uint64 // token moved by the slot
 	Amount            fr.Element
+	Fee               fr.Element // fee charged by a transfer, in FeeToken
+	ValidUntil        uint64     // last batch a transfer may be applied in
+	Recipient         [20]byte   // L1 payout address of a withdrawal
 	SenderPubKeyRaw   []byte
 	ReceiverPubKeyRaw []byte
 	SignatureRaw      []byte
 }
 
-// Operator maintains rollup state: the serialized accounts, their hashed leaves
-// (the Merkle tree input), and an index from public key to position.
+// Operator maintains rollup state: the accounts, the sparse Merkle tree over
+// their commitments, and an index from public key to position. An account's
+// position is not chosen by the operator but derived from its key (see
+// KeyIndex), and no leaf is allocated before an account fills it. It also
+// tracks the transfer fees (in FeeToken) charged since they were last
+// collected. With SetHistoryRetention it also keeps recent past versions of the
+// state, served by AccountAt and ProofAt.
+//
+// An Operator is safe for concurrent use: its methods take a read or a write
+// lock, so any number of readers (ReadAccount, Proof, Root, View) run alongside
+// one writer, and each call sees the state before or after a whole write. Use
+// View to read several values from one version of the state.
 type Operator struct {
-	State      []byte            // concatenated serialized accounts
-	HashState  []byte            // concatenated account-hash leaves, h.Size() bytes each
-	AccountMap map[string]uint64 // pubKey.X bytes -> account index
-	nbAccounts int
-	h          hash.Hash // MiMC hasher
-}
-
-// NewOperator creates an operator managing nbAccounts empty slots, using h as the
-// Merkle/leaf hasher (a native MiMC instance).
-func NewOperator(nbAccounts int, h hash.Hash) Operator {
-	o := Operator{
-		State:      make([]byte, SizeAccount*nbAccounts),
-		HashState:  make([]byte, h.Size()*nbAccounts),
-		AccountMap: make(map[string]uint64),
-		nbAccounts: nbAccounts,
+	accounts   map[Index]Account // the non-empty accounts, by index
+	accountMap map[string]Index  // compressed pubKey bytes -> account index
+	h          chash.StateStorer // HashSuite hasher
+	tree       *merkleTree
+
+	feeCollector Index      // index of the account credited by CollectFees
+	domain       Domain     // the deployment transactions must be signed for
+	auth         Authorizer // the scheme transactions must be signed under
+	batchNumber  uint64     // number of the batch being applied
+	pendingFees  fr.Element // fees charged and not yet collected
+
+	undo    *undoLog // changes of the batch being applied, see ApplyBatch
+	history *history // retained state versions, see SetHistoryRetention
+
+	mu *sync.RWMutex // guards everything above; also serializes the use of h
+}
+
+// NewOperator creates an operator over an empty state tree, using h as the
+// Merkle/leaf hasher (HashSuite.New of the rollup's suite). The tree has
+// 2^StateDepth leaves, each the canonical empty account (see Account.IsEmpty)
+// at its own index, and the circuit's Merkle paths have StateDepth+1 elements
+// (see New). opts are the options the circuit is built with; the operator
+// takes its Domain (WithDomain) and Authorizer (WithAuthorizer) from them, and
+// accepts only transfers and withdrawals signed for that domain under that
+// authorizer.
+func NewOperator(h chash.StateStorer, opts ...Option) *Operator {
+	var empty Account
+	empty.Reset()
+	cfg := options(opts)
+	return &Operator{
+		accounts:   make(map[Index]Account),
+		accountMap: make(map[string]Index),
 		h:          h,
+		tree:       newMerkleTree(h, StateDepth, empty.Hash(h)),
+		domain:     cfg.domain,
+		auth:       cfg.auth,
+		mu:         new(sync.RWMutex),
 	}
-	// initialize leaf hashes for the empty accounts
-	for i := 0; i < nbAccounts; i++ {
-		h.Reset()
-		h.Write(o.State[i*SizeAccount : (i+1)*SizeAccount])
-		copy(o.HashState[i*h.Size():(i+1)*h.Size()], h.Sum(nil))
-	}
-	return o
 }
 
-// AddAccount writes acc into the operator's state at acc.Index and indexes it.
-func (o *Operator) AddAccount(acc Account) {
-	o.AccountMap[string(acc.PubKey.A.X.Marshal())] = acc.Index
+// AddAccount writes acc into the operator's state at the index of its key (see
+// KeyIndex), which it sets as acc.Index, and indexes it; an account of the same
+// key is replaced. It fails with ErrEmptyPubKey for the empty-account key and
+// with ErrKeyMismatch if the leaf holds another key's account. It is not
+// covered by any proof and is meant for setting up a genesis state; use
+// CreateAccount to register an account inside a batch.
+func (o *Operator) AddAccount(acc Account) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if acc.PubKey.A.X.IsZero() {
+		return ErrEmptyPubKey
+	}
+	acc.Index = o.keyIndex(acc.PubKey)
+	if _, err := o.freeLeaf(acc.PubKey, acc.Index); err != nil && err != ErrAccountExists {
+		return err
+	}
+	o.indexKey(acc.PubKey, acc.Index)
 	o.writeAccount(acc)
+	return nil
 }
 
-// writeAccount serializes acc into State and refreshes its leaf in HashState.
-func (o *Operator) writeAccount(acc Account) {
-	pos := int(acc.Index)
-	copy(o.State[pos*SizeAccount:], acc.Serialize())
-	o.h.Reset()
-	o.h.Write(acc.Serialize())
-	copy(o.HashState[pos*o.h.Size():(pos+1)*o.h.Size()], o.h.Sum(nil))
+// keyIndex returns the index of pub's leaf.
+func (o *Operator) keyIndex(pub eddsa.PublicKey) Index {
+	return KeyIndex(pub, o.h)
 }
 
-// ReadAccount returns the account stored at index i.
-func (o *Operator) ReadAccount(i uint64) (Account, error) {
-	if int(i) >= o.nbAccounts {
-		return Account{}, ErrNonExistingAccount
+// freeLeaf returns the account at index, the index of pub's leaf, if the leaf
+// is empty. It fails with ErrAccountExists if pub already has an account and
+// with ErrKeyMismatch if another key's account holds the leaf.
+func (o *Operator) freeLeaf(pub eddsa.PublicKey, index Index) (Account, error) {
+	if _, ok := o.accountIndex(pub); ok {
+		return Account{}, ErrAccountExists
+	}
+	acc := o.readAccount(index)
+	if !acc.IsEmpty() {
+		return Account{}, ErrKeyMismatch
 	}
-	return Deserialize(o.State[int(i)*SizeAccount : int(i)*SizeAccount+SizeAccount])
+	return acc, nil
 }
 
-// proof builds a native Merkle inclusion proof for the leaf at index pos against
-// the current HashState.
-func (o *Operator) proof(pos uint64) (MerkleProofData, error) {
-	root, path, _, err := merkletree.BuildReaderProof(bytes.NewReader(o.HashState), o.h, o.h.Size(), pos)
-	if err != nil {
-		return MerkleProofData{}, err
+// writeAccount stores acc at acc.Index and refreshes its leaf and the path
+// above it in the Merkle tree.
+func (o *Operator) writeAccount(acc Account) {
+	o.recordAccount(acc.Index)
+	o.recordWrite(acc.Index)
+	if acc.IsEmpty() {
+		delete(o.accounts, acc.Index)
+	} else {
+		o.accounts[acc.Index] = acc
+	}
+	o.tree.update(acc.Index, acc.Hash(o.h))
+}
+
+// ReadAccount returns the account stored at index i, the empty account if
+// there is none.
+func (o *Operator) ReadAccount(i Index) Account {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.readAccount(i)
+}
+
+// readAccount is ReadAccount without locking.
+func (o *Operator) readAccount(i Index) Account {
+	if acc, ok := o.accounts[i]; ok {
+		return acc
 	}
-	return MerkleProofData{RootHash: root, Path: path, Index: pos}, nil
+	return emptyAccount(i)
+}
+
+// Root returns the current state root: the Merkle root over the account
+// leaves. It is the value a batch proof starts from (Circuit.OldRoot) or ends
+// on (Circuit.NewRoot).
+func (o *Operator) Root() ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.root()
+}
+
+// root is Root without locking.
+func (o *Operator) root() ([]byte, error) {
+	return append([]byte(nil), o.tree.root()...), nil
+}
+
+// proof returns a native Merkle inclusion proof for the leaf at index pos
+// against the current account leaves, read from the tree in O(depth).
+func (o *Operator) proof(pos Index) MerkleProofData {
+	return MerkleProofData{RootHash: append([]byte(nil), o.tree.root()...), Path: o.tree.proof(pos), Index: pos}
 }
 
 // ApplyTransfer validates t against current state, applies it, and returns a
 // TransferWitness capturing the before/after state and proofs. The transfer must
-// already be signed. It mutates operator state on success.
+// already be signed for the operator's Domain. It mutates operator state on
+// success.
 func (o *Operator) ApplyTransfer(t Transfer) (TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.applyTransfer(t)
+}
+
+// applyTransfer is ApplyTransfer without locking.
+func (o *Operator) applyTransfer(t Transfer) (TransferWitness, error) {
 	var w TransferWitness
 
-	posSender, ok := o.AccountMap[string(t.SenderPubKey.A.X.Marshal())]
+	posSender, ok := o.accountIndex(t.SenderPubKey)
 	if !ok {
 		return w, ErrNonExistingAccount
 	}
-	posReceiver, ok := o.AccountMap[string(t.ReceiverPubKey.A.X.Marshal())]
+	posReceiver, ok := o.accountIndex(t.ReceiverPubKey)
 	if !ok {
 		return w, ErrNonExistingAccount
 	}
-
-	senderBefore, err := o.ReadAccount(posSender)
-	if err != nil {
-		return w, err
-	}
-	receiverBefore, err := o.ReadAccount(posReceiver)
-	if err != nil {
-		return w, err
+	if posSender == posReceiver {
+		// the circuit requires two distinct leaves, see verifyDistinct
+		return w, ErrSelfTransfer
 	}
 
-	// validate the transfer
-	ok, err = t.Verify(o.h)
+	senderBefore := o.readAccount(posSender)
+	receiverBefore := o.readAccount(posReceiver)
+
+	// validate the transfer and compute the updated accounts
+	if t.Domain != o.domain {
+		return w, ErrWrongDomain
+	}
+	ok, err := t.VerifyWith(o.auth, o.h)
 	if err != nil || !ok {
 		return w, ErrWrongSignature
 	}
-	if t.Amount.Cmp(&senderBefore.Balance) > 0 {
+	if t.ValidUntil < o.batchNumber {
+		return w, ErrTransferExpired
+	}
+	if t.TokenID >= NbTokens {
+		return w, ErrInvalidToken
+	}
+	if !senderBefore.inRange() || !receiverBefore.inRange() {
+		return w, ErrBalanceOverflow
+	}
+	// an amount or fee is a balance-width integer, as in the circuit
+	if !inRange(&t.Amount) || !inRange(&t.Fee) {
+		return w, ErrBalanceOverflow
+	}
+	senderAfter := senderBefore
+	receiverAfter := receiverBefore
+	if !debit(&senderAfter.Balances[FeeToken], &t.Fee) ||
+		!debit(&senderAfter.Balances[t.TokenID], &t.Amount) {
 		return w, ErrAmountTooHigh
 	}
 	if t.Nonce != senderBefore.Nonce {
 		return w, ErrNonce
 	}
-
-	// capture "before" roots and proofs (pre-update state)
-	w.RootBefore = nil
-	sproofBefore, err := o.proof(posSender)
-	if err != nil {
-		return w, err
+	credited := &receiverAfter.Balances[t.TokenID]
+	if credited.Add(credited, &t.Amount); !inRange(credited) {
+		return w, ErrBalanceOverflow
 	}
-	rproofBefore, err := o.proof(posReceiver)
-	if err != nil {
-		return w, err
+	// the fees are credited to the collector at the end of the batch, which
+	// must not overflow its balance either
+	collector := senderAfter
+	switch o.feeCollector {
+	case posSender:
+	case posReceiver:
+		collector = receiverAfter
+	default:
+		collector = o.readAccount(o.feeCollector)
+	}
+	if !o.feesFit(collector, &t.Fee) {
+		return w, ErrBalanceOverflow
 	}
-	w.RootBefore = sproofBefore.RootHash
-	w.SenderProofBefore = sproofBefore
-	w.ReceiverProofBefore = rproofBefore
-	w.SenderBefore = senderBefore
-	w.ReceiverBefore = receiverBefore
 
-	// apply the transfer
-	senderAfter := senderBefore
-	receiverAfter := receiverBefore
-	senderAfter.Balance.Sub(&senderBefore.Balance, &t.Amount)
-	receiverAfter.Balance.Add(&receiverBefore.Balance, &t.Amount)
+	// apply the transfer one leaf at a time, capturing each leaf's proof just
+	// before it is written
 	senderAfter.Nonce = senderBefore.Nonce + 1
-
+	w.SenderProof = o.proof(posSender)
 	o.writeAccount(senderAfter)
+	w.ReceiverProof = o.proof(posReceiver)
 	o.writeAccount(receiverAfter)
+	o.pendingFees.Add(&o.pendingFees, &t.Fee)
 
-	// capture "after" roots and proofs (post-update state)
-	sproofAfter, err := o.proof(posSender)
-	if err != nil {
-		return w, err
-	}
-	rproofAfter, err := o.proof(posReceiver)
-	if err != nil {
-		return w, err
-	}
-	w.RootAfter = sproofAfter.RootHash
-	w.SenderProofAfter = sproofAfter
-	w.ReceiverProofAfter = rproofAfter
+	w.RootBefore = w.SenderProof.RootHash
+	w.RootAfter = append([]byte(nil), o.tree.root()...)
+	w.SenderBefore = senderBefore
+	w.ReceiverBefore = receiverBefore
 	w.SenderAfter = senderAfter
 	w.ReceiverAfter = receiverAfter
 
+	w.Type = TxTransfer
+	w.BatchNumber = o.batchNumber
+	w.TokenID = t.TokenID
 	w.Amount = t.Amount
+	w.Fee = t.Fee
+	w.ValidUntil = t.ValidUntil
 	w.SenderPubKeyRaw = t.SenderPubKey.Bytes()
 	w.ReceiverPubKeyRaw = t.ReceiverPubKey.Bytes()
 	w.SignatureRaw = t.SignatureRaw
 
 	return w, nil
 }
+
+// Noop returns a padding witness at the current state: the root is unchanged
+// and both parties are the account at index 0, left untouched. It does not
+// mutate operator state.
+func (o *Operator) Noop() TransferWitness {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.noop()
+}
+
+// noop is Noop without locking.
+func (o *Operator) noop() TransferWitness {
+	acc := o.readAccount(Index{})
+	p := o.proof(Index{})
+	return TransferWitness{
+		Type:           TxNoop,
+		BatchNumber:    o.batchNumber,
+		RootBefore:     p.RootHash,
+		RootAfter:      p.RootHash,
+		SenderBefore:   acc,
+		SenderAfter:    acc,
+		ReceiverBefore: acc,
+		ReceiverAfter:  acc,
+		SenderProof:    p,
+		ReceiverProof:  p,
+	}
+}
+
+// setReceiverWrite fills the batch number, roots, accounts and proofs of w for
+// a slot that only writes the receiver's leaf, from before to after, proof
+// being the leaf's proof before the write: the sender side is an identity
+// update on before, so the receiver's proof serves both sides.
+func (o *Operator) setReceiverWrite(w *TransferWitness, before, after Account, proof MerkleProofData) {
+	w.BatchNumber = o.batchNumber
+	w.RootBefore = proof.RootHash
+	w.RootAfter = append([]byte(nil), o.tree.root()...)
+	w.SenderBefore, w.SenderAfter, w.SenderProof = before, before, proof
+	w.ReceiverBefore, w.ReceiverAfter, w.ReceiverProof = before, after, proof
+}
+
+// PadBatch appends Noop witnesses to ws until it holds batchSize entries, so a
+// partial batch can be assigned to a circuit compiled for batchSize. ws must be
+// the witnesses most recently applied on this operator (the padding starts from
+// the current root). If fees are pending it first appends the CollectFees slot
+// that settles them. It returns ErrBatchTooLarge if ws is already too long.
+func (o *Operator) PadBatch(ws []TransferWitness, batchSize int) ([]TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	padded := append(make([]TransferWitness, 0, batchSize), ws...)
+	if !o.pendingFees.IsZero() {
+		if len(padded) >= batchSize {
+			return nil, ErrBatchTooLarge
+		}
+		w, err := o.collectFees()
+		if err != nil {
+			return nil, err
+		}
+		padded = append(padded, w)
+	}
+	if len(padded) > batchSize {
+		return nil, ErrBatchTooLarge
+	}
+	for len(padded) < batchSize {
+		padded = append(padded, o.noop())
+	}
+	return padded, nil
+}
+
+// ApplyDeposit credits d.Amount of token d.TokenID to the account owned by
+// d.PubKey, creating it at the index of the key (see KeyIndex) if the key has
+// no account yet, and returns the witness for the deposit slot. Creating an
+// account whose leaf holds another key's account fails with ErrKeyMismatch.
+// Deposits come from L1 and carry no L2 signature. Only the receiver side of
+// the witness is meaningful; the sender side is an identity update.
+func (o *Operator) ApplyDeposit(d Deposit) (TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var w TransferWitness
+
+	if d.PubKey.A.X.IsZero() {
+		return w, ErrEmptyPubKey
+	}
+	if d.TokenID >= NbTokens {
+		return w, ErrInvalidToken
+	}
+	if !inRange(&d.Amount) {
+		return w, ErrBalanceOverflow
+	}
+	pos, ok := o.accountIndex(d.PubKey)
+	var before Account
+	if ok {
+		before = o.readAccount(pos)
+	} else {
+		pos = o.keyIndex(d.PubKey)
+		var err error
+		if before, err = o.freeLeaf(d.PubKey, pos); err != nil {
+			return w, err
+		}
+	}
+	after := before
+	after.PubKey = d.PubKey
+	credited := &after.Balances[d.TokenID]
+	if credited.Add(credited, &d.Amount); !before.inRange() || !inRange(credited) {
+		return w, ErrBalanceOverflow
+	}
+	var noFee fr.Element
+	if pos == o.feeCollector && !o.feesFit(after, &noFee) {
+		return w, ErrBalanceOverflow
+	}
+
+	proof := o.proof(pos)
+	o.indexKey(d.PubKey, pos)
+	o.writeAccount(after)
+
+	w.Type = TxDeposit
+	o.setReceiverWrite(&w, before, after, proof)
+	w.TokenID = d.TokenID
+	w.Amount = d.Amount
+	w.ReceiverPubKeyRaw = d.PubKey.Bytes()
+	return w, nil
+}
+
+// ApplyWithdrawal validates the signed withdrawal wd against current state,
+// debits the sender and bumps its nonce, and returns the witness for the
+// withdrawal slot. Only the sender side of the witness is meaningful; the
+// receiver side is an identity update on the debited account.
+func (o *Operator) ApplyWithdrawal(wd Withdrawal) (TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var w TransferWitness
+
+	pos, ok := o.accountIndex(wd.SenderPubKey)
+	if !ok {
+		return w, ErrNonExistingAccount
+	}
+	before := o.readAccount(pos)
+
+	if wd.Domain != o.domain {
+		return w, ErrWrongDomain
+	}
+	ok, err := wd.VerifyWith(o.auth, o.h)
+	if err != nil || !ok {
+		return w, ErrWrongSignature
+	}
+	if wd.TokenID >= NbTokens {
+		return w, ErrInvalidToken
+	}
+	if !before.inRange() {
+		return w, ErrBalanceOverflow
+	}
+	if !inRange(&wd.Amount) {
+		return w, ErrBalanceOverflow
+	}
+	after := before
+	if !debit(&after.Balances[wd.TokenID], &wd.Amount) {
+		return w, ErrAmountTooHigh
+	}
+	if wd.Nonce != before.Nonce {
+		return w, ErrNonce
+	}
+
+	proofBefore := o.proof(pos)
+	after.Nonce = before.Nonce + 1
+	o.writeAccount(after)
+	proofAfter := o.proof(pos)
+
+	w.Type = TxWithdrawal
+	w.BatchNumber = o.batchNumber
+	w.RootBefore = proofBefore.RootHash
+	w.RootAfter = proofAfter.RootHash
+	// the receiver side is an identity update on the debited account
+	w.SenderBefore, w.SenderAfter, w.SenderProof = before, after, proofBefore
+	w.ReceiverBefore, w.ReceiverAfter, w.ReceiverProof = after, after, proofAfter
+	w.TokenID = wd.TokenID
+	w.Amount = wd.Amount
+	w.Recipient = wd.Recipient
+	w.SenderPubKeyRaw = wd.SenderPubKey.Bytes()
+	w.SignatureRaw = wd.SignatureRaw
+	return w, nil
+}
+
+// CreateAccount registers pub as a new account with zero balance at the index
+// of the key (see KeyIndex) and returns the witness for the registration slot,
+// so account creation is covered by the batch proof. It rejects keys that
+// already have an account (ErrAccountExists) and keys whose leaf holds another
+// key's account (ErrKeyMismatch). Only the receiver side of the witness is
+// meaningful; the sender side is an identity update.
+func (o *Operator) CreateAccount(pub eddsa.PublicKey) (TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var w TransferWitness
+
+	if pub.A.X.IsZero() {
+		return w, ErrEmptyPubKey
+	}
+	index := o.keyIndex(pub)
+	before, err := o.freeLeaf(pub, index)
+	if err != nil {
+		return w, err
+	}
+
+	proof := o.proof(index)
+	after := before
+	after.PubKey = pub
+	o.indexKey(pub, index)
+	o.writeAccount(after)
+
+	w.Type = TxCreate
+	o.setReceiverWrite(&w, before, after, proof)
+	w.ReceiverPubKeyRaw = pub.Bytes()
+	return w, nil
+}
+
+// SetFeeCollector designates the account at index as the one credited with
+// transfer fees. It must match the collector the circuit was compiled with (see
+// WithFeeCollector); the default is index 0. It fails with
+// ErrNonExistingAccount if the leaf at index is empty, as fees credited there
+// would belong to no key.
+func (o *Operator) SetFeeCollector(index Index) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if acc := o.readAccount(index); acc.IsEmpty() {
+		return ErrNonExistingAccount
+	}
+	o.feeCollector = index
+	return nil
+}
+
+// SetBatchNumber sets the number of the batch that the following transactions
+// are applied in (0 by default). It is recorded in their witnesses, which the
+// circuit exposes as the batch's public BatchNumber, and transfers whose
+// ValidUntil is below it fail with ErrTransferExpired. A sequencer sets it
+// before applying each batch. Moving to another number ends the previous
+// batch, whose state the history keeps (see SetHistoryRetention). A Store
+// persists the number with every snapshot and committed batch, so OpenStore
+// restores it.
+func (o *Operator) SetBatchNumber(n uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n != o.batchNumber {
+		o.history.cut(o.tree.root())
+	}
+	o.batchNumber = n
+}
+
+// BatchNumber returns the batch number set by SetBatchNumber.
+func (o *Operator) BatchNumber() uint64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.batchNumber
+}
+
+// Domain returns the Domain the operator was created with.
+func (o *Operator) Domain() Domain {
+	return o.domain
+}
+
+// Authorizer returns the Authorizer the operator was created with.
+func (o *Operator) Authorizer() Authorizer {
+	return o.auth
+}
+
+// CollectFees credits the fee collector's FeeToken balance with every fee
+// charged since the last collection and returns the witness for the settlement
+// slot. The circuit only accepts a batch whose collected fees equal the fees
+// its transfers charged, so a batch that applies fee-paying transfers must end
+// with this slot (PadBatch adds it). Only the receiver side of the witness is
+// meaningful; the sender side is an identity update.
+func (o *Operator) CollectFees() (TransferWitness, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.collectFees()
+}
+
+// feesFit reports whether collector, the fee collector's account as the slot
+// being applied leaves it, can still be credited with the pending fees plus
+// fee in one CollectFees slot.
+func (o *Operator) feesFit(collector Account, fee *fr.Element) bool {
+	if o.pendingFees.IsZero() && fee.IsZero() {
+		return true
+	}
+	var total fr.Element
+	total.Add(&collector.Balances[FeeToken], &o.pendingFees).Add(&total, fee)
+	return inRange(&total)
+}
+
+// collectFees is CollectFees without locking.
+func (o *Operator) collectFees() (TransferWitness, error) {
+	var w TransferWitness
+
+	before := o.readAccount(o.feeCollector)
+	after := before
+	credited := &after.Balances[FeeToken]
+	if credited.Add(credited, &o.pendingFees); !before.inRange() || !inRange(credited) {
+		return w, ErrBalanceOverflow
+	}
+
+	proof := o.proof(o.feeCollector)
+	o.writeAccount(after)
+
+	w.Type = TxCollectFees
+	o.setReceiverWrite(&w, before, after, proof)
+	w.Amount = o.pendingFees
+	o.pendingFees.SetZero()
+	return w, nil
+}
@@ -1,10 +1,12 @@
 package rollup
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"math/rand"
 	"testing"
 
-	"github.com/consensys/gnark-crypto/accumulator/merkletree"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
@@ -17,18 +19,28 @@ func newElem(v uint64) fr.Element {
 }
 
 // newTestOperator builds an operator with n deterministic accounts, account i
-// having balance 20+i. Returns the operator and the private keys.
-func newTestOperator(t *testing.T, n int) (Operator, []eddsa.PrivateKey) {
+// having balance 20+i. Returns the operator and the private keys, in account
+// order.
+func newTestOperator(t *testing.T, n int, opts ...Option) (*Operator, []eddsa.PrivateKey) {
 	t.Helper()
 	r := rand.New(rand.NewSource(7)) //#nosec G404 -- deterministic test
-	op := NewOperator(n, cmimc.NewMiMC())
+	return addAccounts(t, NewOperator(cmimc.NewMiMC(), opts...), n, 20, r)
+}
+
+// addAccounts adds n accounts with fresh keys drawn from r to op, account i
+// having balance base+i. It returns op and the accounts' private keys, in
+// order.
+func addAccounts(t testing.TB, op *Operator, n int, base uint64, r io.Reader) (*Operator, []eddsa.PrivateKey) {
+	t.Helper()
 	privs := make([]eddsa.PrivateKey, n)
-	for i := 0; i < n; i++ {
-		acc, priv, err := NewAccount(i, uint64(20+i), r)
+	for i := range privs {
+		acc, priv, err := NewAccount(base+uint64(i), r)
 		if err != nil {
 			t.Fatalf("account %d: %v", i, err)
 		}
-		op.AddAccount(acc)
+		if err := op.AddAccount(acc); err != nil {
+			t.Fatalf("add account %d: %v", i, err)
+		}
 		privs[i] = priv
 	}
 	return op, privs
@@ -37,10 +49,10 @@ func newTestOperator(t *testing.T, n int) (Operator, []eddsa.PrivateKey) {
 func TestApplyTransferUpdatesBalances(t *testing.T) {
 	op, privs := newTestOperator(t, 16)
 
-	sender, _ := op.ReadAccount(0)
-	receiver, _ := op.ReadAccount(1)
-	wantSender := sender.Balance
-	wantReceiver := receiver.Balance
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	wantSender := sender.Balances[FeeToken]
+	wantReceiver := receiver.Balances[FeeToken]
 
 	transfer := NewTransfer(5, sender.PubKey, receiver.PubKey, sender.Nonce)
 	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
@@ -56,10 +68,10 @@ func TestApplyTransferUpdatesBalances(t *testing.T) {
 	five, expSender, expReceiver := newElem(5), wantSender, wantReceiver
 	expSender.Sub(&expSender, &five)
 	expReceiver.Add(&expReceiver, &five)
-	if !w.SenderAfter.Balance.Equal(&expSender) {
+	if !w.SenderAfter.Balances[FeeToken].Equal(&expSender) {
 		t.Fatal("sender balance not decremented correctly")
 	}
-	if !w.ReceiverAfter.Balance.Equal(&expReceiver) {
+	if !w.ReceiverAfter.Balances[FeeToken].Equal(&expReceiver) {
 		t.Fatal("receiver balance not incremented correctly")
 	}
 	if w.SenderAfter.Nonce != w.SenderBefore.Nonce+1 {
@@ -72,8 +84,8 @@ func TestApplyTransferProofsVerifyNatively(t *testing.T) {
 	op, privs := newTestOperator(t, n)
 	h := cmimc.NewMiMC()
 
-	sender, _ := op.ReadAccount(0)
-	receiver, _ := op.ReadAccount(1)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
 	transfer := NewTransfer(3, sender.PubKey, receiver.PubKey, sender.Nonce)
 	if _, err := transfer.Sign(privs[0], h); err != nil {
 		t.Fatalf("sign: %v", err)
@@ -85,20 +97,25 @@ func TestApplyTransferProofsVerifyNatively(t *testing.T) {
 	}
 
 	check := func(name string, p MerkleProofData) {
-		if !merkletree.VerifyProof(h, p.RootHash, p.Path, p.Index, n) {
+		if !verifyProof(h, p) {
 			t.Fatalf("%s merkle proof failed native verification", name)
 		}
 	}
-	check("sender-before", w.SenderProofBefore)
-	check("receiver-before", w.ReceiverProofBefore)
-	check("sender-after", w.SenderProofAfter)
-	check("receiver-after", w.ReceiverProofAfter)
+	check("sender", w.SenderProof)
+	check("receiver", w.ReceiverProof)
+	if !bytes.Equal(w.SenderProof.RootHash, w.RootBefore) {
+		t.Fatal("sender proof is not against the root before the transfer")
+	}
+	// the receiver is proven once the sender is written
+	if bytes.Equal(w.ReceiverProof.RootHash, w.RootBefore) || bytes.Equal(w.ReceiverProof.RootHash, w.RootAfter) {
+		t.Fatal("receiver proof is not against the root between the two writes")
+	}
 }
 
 func TestApplyTransferRejectsBadNonce(t *testing.T) {
 	op, privs := newTestOperator(t, 16)
-	sender, _ := op.ReadAccount(0)
-	receiver, _ := op.ReadAccount(1)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
 
 	transfer := NewTransfer(1, sender.PubKey, receiver.PubKey, sender.Nonce+9)
 	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
@@ -111,8 +128,8 @@ func TestApplyTransferRejectsBadNonce(t *testing.T) {
 
 func TestApplyTransferRejectsOverdraft(t *testing.T) {
 	op, privs := newTestOperator(t, 16)
-	sender, _ := op.ReadAccount(0) // balance 20
-	receiver, _ := op.ReadAccount(1)
+	sender := accountOf(t, op, privs[0]) // balance 20
+	receiver := accountOf(t, op, privs[1])
 
 	transfer := NewTransfer(1_000, sender.PubKey, receiver.PubKey, sender.Nonce)
 	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
@@ -122,3 +139,360 @@ func TestApplyTransferRejectsOverdraft(t *testing.T) {
 		t.Fatalf("expected ErrAmountTooHigh, got %v", err)
 	}
 }
+
+func TestApplyTransferRejectsMirroredKey(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	root, _ := op.Root()
+
+	// (x, -y) is on the curve too, and shares the receiver's X coordinate
+	other := receiver.PubKey
+	other.A.Y.Neg(&other.A.Y)
+	transfer := NewTransfer(1, sender.PubKey, other, sender.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(transfer); err != ErrNonExistingAccount {
+		t.Fatalf("expected ErrNonExistingAccount, got %v", err)
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, root) {
+		t.Fatal("a rejected transfer changed the state")
+	}
+}
+
+func TestRootTracksAppliedTransfers(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	before, err := op.Root()
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	transfer := NewTransfer(2, sender.PubKey, receiver.PubKey, sender.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	w, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	after, err := op.Root()
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	if !bytes.Equal(w.RootBefore, before) {
+		t.Fatal("witness RootBefore does not match the root before the transfer")
+	}
+	if !bytes.Equal(w.RootAfter, after) {
+		t.Fatal("witness RootAfter does not match the root after the transfer")
+	}
+}
+
+func TestApplyTransferRejectsReceiverOverflow(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	receiver.Balances[FeeToken].SetUint64(^uint64(0)) // already at 2^BalanceBits - 1
+	op.writeAccount(receiver)
+
+	transfer := NewTransfer(1, sender.PubKey, receiver.PubKey, sender.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(transfer); err != ErrBalanceOverflow {
+		t.Fatalf("expected ErrBalanceOverflow, got %v", err)
+	}
+	if got := accountOf(t, op, privs[0]); got.Nonce != sender.Nonce {
+		t.Fatal("rejected transfer must not touch the sender")
+	}
+}
+
+func TestApplyTransferRejectsWideAmount(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	var wide fr.Element
+	wide.SetUint64(1 << 63).Double(&wide) // 2^BalanceBits
+
+	for _, tc := range []struct {
+		name        string
+		amount, fee fr.Element
+	}{
+		{"amount", wide, fr.Element{}},
+		{"fee", newElem(1), wide},
+	} {
+		transfer := NewTransfer(0, sender.PubKey, receiver.PubKey, sender.Nonce)
+		transfer.Amount, transfer.Fee = tc.amount, tc.fee
+		if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		if _, err := op.ApplyTransfer(transfer); err != ErrBalanceOverflow {
+			t.Fatalf("%s at 2^BalanceBits: expected ErrBalanceOverflow, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestPadBatch(t *testing.T) {
+	op, _ := newTestOperator(t, 16)
+	root, _ := op.Root()
+
+	padded, err := op.PadBatch(nil, 2)
+	if err != nil {
+		t.Fatalf("pad: %v", err)
+	}
+	if len(padded) != 2 {
+		t.Fatalf("padded batch has %d entries, want 2", len(padded))
+	}
+	for i, w := range padded {
+		if w.Type != TxNoop {
+			t.Fatalf("entry %d: type %d, want TxNoop", i, w.Type)
+		}
+		if !bytes.Equal(w.RootBefore, root) || !bytes.Equal(w.RootAfter, root) {
+			t.Fatalf("entry %d: no-op must start and end on the current root", i)
+		}
+	}
+	if after, _ := op.Root(); !bytes.Equal(after, root) {
+		t.Fatal("padding must not change operator state")
+	}
+
+	if _, err := op.PadBatch(padded, 1); err != ErrBatchTooLarge {
+		t.Fatalf("expected ErrBatchTooLarge, got %v", err)
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	op := NewOperator(cmimc.NewMiMC())
+	pub, _ := newKey(t, 31)
+
+	w, err := op.CreateAccount(pub)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	index := KeyIndex(pub, cmimc.NewMiMC())
+	acc := op.ReadAccount(index)
+	if acc.IsEmpty() || !acc.PubKey.A.Equal(&pub.A) || !acc.Balances[FeeToken].IsZero() || acc.Nonce != 0 {
+		t.Fatal("the key's leaf does not hold the new zero-balance account")
+	}
+	if w.Type != TxCreate || !w.ReceiverBefore.IsEmpty() {
+		t.Fatal("witness does not describe a registration into an empty leaf")
+	}
+	if root, _ := op.Root(); !bytes.Equal(root, w.RootAfter) {
+		t.Fatal("witness RootAfter does not match the operator root")
+	}
+
+	if _, err := op.CreateAccount(pub); err != ErrAccountExists {
+		t.Fatalf("duplicate key: expected ErrAccountExists, got %v", err)
+	}
+	other, _ := newKey(t, 32)
+	occupyLeaf(t, op, other)
+	if _, err := op.CreateAccount(other); err != ErrKeyMismatch {
+		t.Fatalf("taken leaf: expected ErrKeyMismatch, got %v", err)
+	}
+}
+
+func TestAddAccount(t *testing.T) {
+	op, privs := newTestOperator(t, 2)
+	acc := accountOf(t, op, privs[0])
+	acc.Balances[FeeToken].SetUint64(7)
+	acc.Index = Index{}
+	if err := op.AddAccount(acc); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if got, want := accountOf(t, op, privs[0]).Balances[FeeToken], newElem(7); !got.Equal(&want) {
+		t.Fatal("AddAccount did not replace the key's account")
+	}
+
+	acc.PubKey, _ = newKey(t, 32)
+	occupyLeaf(t, op, acc.PubKey)
+	if err := op.AddAccount(acc); err != ErrKeyMismatch {
+		t.Fatalf("taken leaf: expected ErrKeyMismatch, got %v", err)
+	}
+	var empty Account
+	empty.Reset()
+	if err := op.AddAccount(empty); err != ErrEmptyPubKey {
+		t.Fatalf("empty key: expected ErrEmptyPubKey, got %v", err)
+	}
+}
+
+func TestApplyTransferChargesFee(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	if err := op.SetFeeCollector(indexOf(t, op, privs[5])); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	sender := accountOf(t, op, privs[0])    // balance 20
+	receiver := accountOf(t, op, privs[1])  // balance 21
+	collector := accountOf(t, op, privs[5]) // balance 25
+
+	for k, fee := range []uint64{2, 3} {
+		transfer := NewTransferWithFee(4, fee, sender.PubKey, receiver.PubKey, uint64(k))
+		if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		if _, err := op.ApplyTransfer(transfer); err != nil {
+			t.Fatalf("apply %d: %v", k, err)
+		}
+	}
+	if got, want := accountOf(t, op, privs[0]).Balances[FeeToken], newElem(20-8-5); !got.Equal(&want) {
+		t.Fatal("sender must pay amount plus fee")
+	}
+	if got, want := accountOf(t, op, privs[1]).Balances[FeeToken], newElem(21+8); !got.Equal(&want) {
+		t.Fatal("receiver must get the amount only")
+	}
+	if got := accountOf(t, op, privs[5]).Balances[FeeToken]; !got.Equal(&collector.Balances[FeeToken]) {
+		t.Fatal("fees must not reach the collector before they are collected")
+	}
+
+	w, err := op.CollectFees()
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if want := newElem(5); w.Type != TxCollectFees || !w.Amount.Equal(&want) || w.ReceiverAfter.Index != collector.Index {
+		t.Fatal("settlement witness does not credit the collected fees")
+	}
+	if got, want := accountOf(t, op, privs[5]).Balances[FeeToken], newElem(25+5); !got.Equal(&want) {
+		t.Fatal("collector was not credited the fees")
+	}
+}
+
+func TestSetFeeCollectorRejectsEmptyLeaf(t *testing.T) {
+	op, privs := newTestOperator(t, 2)
+	collector := indexOf(t, op, privs[1])
+	if err := op.SetFeeCollector(collector); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	if err := op.SetFeeCollector(testIndex(1)); !errors.Is(err, ErrNonExistingAccount) {
+		t.Fatalf("empty leaf: expected ErrNonExistingAccount, got %v", err)
+	}
+	if op.feeCollector != collector {
+		t.Fatal("a refused collector replaced the previous one")
+	}
+}
+
+func TestApplyTransferRejectsFeeOverdraft(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	sender := accountOf(t, op, privs[0]) // balance 20
+	receiver := accountOf(t, op, privs[1])
+
+	transfer := NewTransferWithFee(15, 6, sender.PubKey, receiver.PubKey, sender.Nonce)
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(transfer); err != ErrAmountTooHigh {
+		t.Fatalf("expected ErrAmountTooHigh, got %v", err)
+	}
+}
+
+func TestApplyTransferRejectsFeeOverflow(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	collector := accountOf(t, op, privs[0])
+	collector.Balances[FeeToken].SetUint64(^uint64(0) - 1) // 2^BalanceBits - 2
+	op.writeAccount(collector)
+	if err := op.SetFeeCollector(collector.Index); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	sender := accountOf(t, op, privs[1])
+	receiver := accountOf(t, op, privs[2])
+
+	transfers := make([]Transfer, 2)
+	for k := range transfers {
+		transfers[k] = NewTransferWithFee(1, 1, sender.PubKey, receiver.PubKey, uint64(k))
+		if _, err := transfers[k].Sign(privs[1], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	}
+	root, _ := op.Root()
+	// the second fee would take the collected balance to 2^BalanceBits
+	if _, err := op.ApplyBatch(transfers); !errors.Is(err, ErrBalanceOverflow) {
+		t.Fatalf("expected ErrBalanceOverflow, got %v", err)
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, root) || op.hasPendingFees() {
+		t.Fatal("a rejected batch changed the state or the pending fees")
+	}
+
+	// the first fee still fits and is collected
+	ws, err := op.ApplyBatch(transfers[:1])
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, err := op.PadBatch(ws, 2); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if got, want := accountOf(t, op, privs[0]).Balances[FeeToken], newElem(^uint64(0)); !got.Equal(&want) {
+		t.Fatal("collector was not credited the fee")
+	}
+}
+
+func TestApplyTransferMovesOneToken(t *testing.T) {
+	op, privs := newTestOperator(t, 16)
+	sender := accountOf(t, op, privs[0])   // FeeToken balance 20
+	receiver := accountOf(t, op, privs[1]) // FeeToken balance 21
+	d := NewDeposit(30, sender.PubKey)
+	d.TokenID = 2
+	if _, err := op.ApplyDeposit(d); err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+
+	transfer := NewTransferWithFee(12, 3, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.TokenID = 2
+	if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(transfer); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	got, want := accountOf(t, op, privs[0]), newAccountBalances(20-3, 0, 30-12, 0)
+	if got.Balances != want {
+		t.Fatal("sender must pay the amount in the token and the fee in FeeToken")
+	}
+	if got, want := accountOf(t, op, privs[1]), newAccountBalances(21, 0, 12, 0); got.Balances != want {
+		t.Fatal("receiver must be credited in the transferred token only")
+	}
+
+	// the token balance, not the FeeToken balance, bounds the amount
+	overdraft := NewTransfer(19, sender.PubKey, receiver.PubKey, sender.Nonce+1)
+	overdraft.TokenID = 2
+	if _, err := overdraft.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(overdraft); err != ErrAmountTooHigh {
+		t.Fatalf("expected ErrAmountTooHigh, got %v", err)
+	}
+
+	unknown := NewTransfer(1, sender.PubKey, receiver.PubKey, sender.Nonce+1)
+	unknown.TokenID = NbTokens
+	if _, err := unknown.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyTransfer(unknown); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+// newAccountBalances returns a balance array holding the given values.
+func newAccountBalances(vs ...uint64) [NbTokens]fr.Element {
+	var b [NbTokens]fr.Element
+	for i, v := range vs {
+		b[i] = newElem(v)
+	}
+	return b
+}
+
+// indexOf returns the index of the account owned by priv's key.
+func indexOf(t testing.TB, op *Operator, priv eddsa.PrivateKey) Index {
+	t.Helper()
+	i, ok := op.AccountIndex(priv.PublicKey)
+	if !ok {
+		t.Fatal("key has no account")
+	}
+	return i
+}
+
+// accountOf returns the account owned by priv's key.
+func accountOf(t testing.TB, op *Operator, priv eddsa.PrivateKey) Account {
+	t.Helper()
+	return op.ReadAccount(indexOf(t, op, priv))
+}
@@ -0,0 +1,376 @@
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
+)
+
+// ErrSequencerBatchSize is returned by NewSequencer for a batch size below 2:
+// a batch needs room for the slot that collects its transfers' fees.
+var ErrSequencerBatchSize = errors.New("rollup: sequencer batch size must be at least 2")
+
+// DefaultPollInterval is how often a Sequencer checks its mempool when
+// SequencerConfig.PollInterval is zero.
+const DefaultPollInterval = 10 * time.Millisecond
+
+// DefaultSnapshotEvery is how many published batches a Sequencer lets the
+// Store's log grow by between snapshots when SequencerConfig.SnapshotEvery is
+// zero.
+const DefaultSnapshotEvery = 64
+
+// BatchResult is a batch sealed, applied and proven by a Sequencer.
+type BatchResult struct {
+	Number        uint64 // position of the batch, from SequencerConfig.FirstBatch
+	OldRoot       []byte
+	NewRoot       []byte
+	Public        PublicData
+	Proof         groth16.Proof
+	PublicWitness witness.Witness
+	Data          []TxData // the batch's published data, see EncodeBatch
+}
+
+// Sink receives the batches a Sequencer proves, one at a time and in order, for
+// example to submit them to L1. An error stops the sequencer.
+type Sink interface {
+	Publish(ctx context.Context, r BatchResult) error
+}
+
+// SinkFunc adapts a function to the Sink interface.
+type SinkFunc func(ctx context.Context, r BatchResult) error
+
+// Publish calls f(ctx, r).
+func (f SinkFunc) Publish(ctx context.Context, r BatchResult) error {
+	return f(ctx, r)
+}
+
+// SequencerConfig configures a Sequencer.
+type SequencerConfig struct {
+	// BatchSize is the number of slots of the compiled circuit. A batch holds
+	// up to BatchSize transfers, or BatchSize-1 when they charge fees, and is
+	// padded with the fee collection and no-ops.
+	BatchSize int
+	// Timeout seals a batch that is not full once transfers have waited this
+	// long. Zero seals full batches only.
+	Timeout time.Duration
+	// PollInterval is how often the mempool is checked; DefaultPollInterval
+	// if zero.
+	PollInterval time.Duration
+	// FirstBatch is the number of the first batch sealed. Batches are numbered
+	// consecutively from it, and each number is set on the operator (see
+	// Operator.SetBatchNumber) before the batch is selected, so transfers
+	// expire by it; if no batch seals, the operator's number is restored, so
+	// it is always that of the last sealed batch. When Store already holds
+	// committed batches, numbering continues after the operator's batch
+	// number instead.
+	FirstBatch uint64
+	// Store, if set, commits every batch once applied and records it once
+	// published. Batches it holds committed but unpublished, left by a
+	// previous run, are proven and published first.
+	Store *Store
+	// SnapshotEvery is the number of published batches after which the
+	// operator is snapshotted into Store, which drops them from its log;
+	// DefaultSnapshotEvery if zero.
+	SnapshotEvery int
+	// Options are the options the circuit was compiled with.
+	Options []Option
+}
+
+// Sequencer turns a mempool into proven batches. It seals a batch when enough
+// transfers are ready or the timeout expires, applies it on the operator,
+// commits it to the store, and proves it in the background while the next batch
+// fills; each proven batch is handed to the sink as a BatchResult, in order.
+//
+// The sequencer must be the operator's only writer.
+type Sequencer struct {
+	op      *Operator
+	pool    *Mempool
+	sink    Sink
+	cfg     SequencerConfig
+	pathLen int
+	next    uint64 // number of the next batch
+	prove   func(assignment frontend.Circuit) (groth16.Proof, witness.Witness, error)
+
+	published   atomic.Uint64 // batches published by this sequencer
+	snapshotted uint64        // published when the Store was last snapshotted
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// sealedBatch is a batch applied and waiting for its proof.
+type sealedBatch struct {
+	number    uint64
+	seq       uint64 // Store sequence number, 0 without a Store
+	witnesses []TransferWitness
+}
+
+// NewSequencer returns a sequencer that applies the transfers of pool on op and
+// proves the batches with the compiled circuit ccs and its proving key pk, the
+// circuit being New(cfg.BatchSize, pathLen, cfg.Options...) for op's Merkle path
+// length.
+func NewSequencer(op *Operator, pool *Mempool, ccs constraint.ConstraintSystem, pk groth16.ProvingKey, sink Sink, cfg SequencerConfig) (*Sequencer, error) {
+	if cfg.BatchSize < 2 {
+		return nil, ErrSequencerBatchSize
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.SnapshotEvery == 0 {
+		cfg.SnapshotEvery = DefaultSnapshotEvery
+	}
+	p := op.Proof(Index{})
+	next := cfg.FirstBatch
+	if cfg.Store != nil && cfg.Store.Seq() > 0 {
+		next = op.BatchNumber() + 1
+	}
+	return &Sequencer{
+		op:      op,
+		pool:    pool,
+		sink:    sink,
+		cfg:     cfg,
+		pathLen: len(p.Path),
+		next:    next,
+		prove: func(assignment frontend.Circuit) (groth16.Proof, witness.Witness, error) {
+			return prove.Prove(ccs, pk, assignment)
+		},
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Run seals, applies and proves batches until Shutdown is called or ctx is
+// done, and must be called once. It starts with the batches the Store holds
+// committed but unpublished, if any. With a Store, it snapshots the operator
+// every SnapshotEvery published batches, and once more before a graceful
+// return, so the log stays short. After Shutdown it finishes proving and
+// publishing the batches already sealed and returns nil. When ctx is done it
+// returns ctx.Err() once the proof in progress, if any, completes, without
+// publishing it: that batch and any other sealed one are applied (and
+// committed) but unpublished, and with a Store the next Run publishes them. A
+// failure to apply, commit, prove or publish a batch stops the sequencer and
+// is returned.
+func (s *Sequencer) Run(ctx context.Context) error {
+	defer close(s.done)
+
+	var backlog []sealedBatch
+	if s.cfg.Store != nil {
+		for _, b := range s.cfg.Store.Unpublished() {
+			backlog = append(backlog, sealedBatch{number: b.Number, seq: b.Seq, witnesses: b.Witnesses})
+		}
+	}
+
+	// one batch proves while the next one is sealed
+	sealed := make(chan sealedBatch, 1)
+	proverErr := make(chan error, 1)
+	proverDone := make(chan struct{})
+	go func() {
+		defer close(proverDone)
+		fail := func(err error) {
+			proverErr <- err
+			for range sealed {
+			}
+		}
+		for _, b := range backlog {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := s.publish(ctx, b); err != nil {
+				fail(err)
+				return
+			}
+		}
+		for b := range sealed {
+			if ctx.Err() != nil {
+				continue
+			}
+			if err := s.publish(ctx, b); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	var since time.Time // when the pending transfers were first seen
+	var err error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case <-s.quit:
+			break loop
+		case err = <-proverErr:
+			break loop
+		case <-ticker.C:
+		}
+		if err = s.snapshot(false); err != nil {
+			break loop
+		}
+		b, ok, sealErr := s.seal(&since)
+		if sealErr != nil {
+			err = sealErr
+			break loop
+		}
+		if !ok {
+			continue
+		}
+		select {
+		case sealed <- b:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case err = <-proverErr:
+			break loop
+		}
+	}
+	close(sealed)
+	<-proverDone
+	if err == nil {
+		select {
+		case err = <-proverErr:
+		default:
+		}
+	}
+	if err == nil {
+		err = s.snapshot(true)
+	}
+	return err
+}
+
+// snapshot snapshots the operator into the Store once SnapshotEvery batches
+// were published since the last snapshot, or if force once any was. Only the
+// goroutine that seals batches calls it, so every applied batch is committed.
+func (s *Sequencer) snapshot(force bool) error {
+	if s.cfg.Store == nil {
+		return nil
+	}
+	n := s.published.Load()
+	if n == s.snapshotted || (!force && n-s.snapshotted < uint64(s.cfg.SnapshotEvery)) {
+		return nil
+	}
+	if err := s.cfg.Store.Snapshot(s.op); err != nil {
+		return fmt.Errorf("rollup: snapshotting the state: %w", err)
+	}
+	s.snapshotted = n
+	return nil
+}
+
+// Shutdown stops the sequencer gracefully: Run seals no more batches, finishes
+// those already sealed and returns. Shutdown waits for that until ctx is done.
+func (s *Sequencer) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.quit) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// seal applies the next batch if it is due: full, or not empty and waiting since
+// longer than the timeout. since tracks when transfers were first seen waiting.
+func (s *Sequencer) seal(since *time.Time) (sealedBatch, bool, error) {
+	// transfers are selected by the number of the batch they would seal; the
+	// operator keeps it only if that batch seals, so a snapshot never records
+	// a number no batch was sealed with
+	last := s.op.BatchNumber()
+	s.op.SetBatchNumber(s.next)
+	transfers := s.pool.Batch(s.cfg.BatchSize)
+	if len(transfers) == 0 {
+		*since = time.Time{}
+		s.op.SetBatchNumber(last)
+		return sealedBatch{}, false, nil
+	}
+	full := len(transfers) == s.cfg.BatchSize
+	if full && (s.op.hasPendingFees() || chargesFees(transfers)) {
+		// keep the last slot for the fee collection
+		transfers = transfers[:len(transfers)-1]
+	}
+	if since.IsZero() {
+		*since = time.Now()
+	}
+	if !full && (s.cfg.Timeout == 0 || time.Since(*since) < s.cfg.Timeout) {
+		s.op.SetBatchNumber(last)
+		return sealedBatch{}, false, nil
+	}
+
+	ws, err := s.op.ApplyBatch(transfers)
+	if err != nil {
+		return sealedBatch{}, false, fmt.Errorf("rollup: applying batch %d: %w", s.next, err)
+	}
+	if ws, err = s.op.PadBatch(ws, s.cfg.BatchSize); err != nil {
+		return sealedBatch{}, false, fmt.Errorf("rollup: padding batch %d: %w", s.next, err)
+	}
+	b := sealedBatch{number: s.next, witnesses: ws}
+	if s.cfg.Store != nil {
+		if err := s.cfg.Store.Commit(ws); err != nil {
+			return sealedBatch{}, false, fmt.Errorf("rollup: committing batch %d: %w", s.next, err)
+		}
+		b.seq = s.cfg.Store.Seq()
+	}
+	*since = time.Time{}
+	s.next++
+	return b, true, nil
+}
+
+// publish proves a sealed batch and hands the result to the sink.
+func (s *Sequencer) publish(ctx context.Context, b sealedBatch) error {
+	proof, public, err := s.prove(Assign(b.witnesses, s.pathLen, s.cfg.Options...))
+	if err != nil {
+		return fmt.Errorf("rollup: proving batch %d: %w", b.number, err)
+	}
+	p := BatchPublicData(b.witnesses, s.cfg.Options...)
+	r := BatchResult{
+		Number:        b.number,
+		OldRoot:       p.OldRoot,
+		NewRoot:       p.NewRoot,
+		Public:        p,
+		Proof:         proof,
+		PublicWitness: public,
+		Data:          BatchData(b.witnesses),
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := s.sink.Publish(ctx, r); err != nil {
+		return fmt.Errorf("rollup: publishing batch %d: %w", b.number, err)
+	}
+	if s.cfg.Store != nil {
+		if err := s.cfg.Store.MarkPublished(b.seq); err != nil {
+			return fmt.Errorf("rollup: recording batch %d as published: %w", b.number, err)
+		}
+	}
+	s.published.Add(1)
+	return nil
+}
+
+// chargesFees reports whether any of the transfers pays a fee.
+func chargesFees(transfers []Transfer) bool {
+	for i := range transfers {
+		if !transfers[i].Fee.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPendingFees reports whether fees are waiting for CollectFees.
+func (o *Operator) hasPendingFees() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return !o.pendingFees.IsZero()
+}
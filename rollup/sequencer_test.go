@@ -0,0 +1,329 @@
+package rollup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/prove"
+)
+
+// solvingSequencer returns a sequencer over op whose prover only checks that
+// each batch solves the circuit, and the channel its sink publishes to.
+func solvingSequencer(t *testing.T, op *Operator, pool *Mempool, cfg SequencerConfig) (*Sequencer, chan BatchResult) {
+	t.Helper()
+	results := make(chan BatchResult, 16)
+	s, err := NewSequencer(op, pool, nil, nil, SinkFunc(func(_ context.Context, r BatchResult) error {
+		results <- r
+		return nil
+	}), cfg)
+	if err != nil {
+		t.Fatalf("sequencer: %v", err)
+	}
+	s.prove = func(assignment frontend.Circuit) (groth16.Proof, witness.Witness, error) {
+		return nil, nil, test.IsSolved(New(cfg.BatchSize, s.pathLen), assignment, ecc.BN254.ScalarField())
+	}
+	return s, results
+}
+
+// nextResult waits for the next published batch.
+func nextResult(t *testing.T, results chan BatchResult) BatchResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(30 * time.Second):
+		t.Fatal("no batch published")
+		return BatchResult{}
+	}
+}
+
+func TestSequencerSealsBySizeAndTimeout(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	pool := NewMempool(op, cmimc.NewMiMC())
+	s, results := solvingSequencer(t, op, pool, SequencerConfig{
+		BatchSize:  4,
+		Timeout:    100 * time.Millisecond,
+		FirstBatch: 7,
+	})
+	// 4 fee-paying transfers: a full batch takes 3 plus the fee collection,
+	// the last one waits for the timeout
+	for nonce := uint64(0); nonce < 4; nonce++ {
+		if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 1, nonce)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	root, _ := op.Root()
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(context.Background()) }()
+
+	first := nextResult(t, results)
+	second := nextResult(t, results)
+	if first.Number != 7 || second.Number != 8 || first.Public.BatchNumber != 7 || second.Public.BatchNumber != 8 {
+		t.Fatalf("batch numbers %d, %d; want 7, 8", first.Number, second.Number)
+	}
+	if !bytes.Equal(first.OldRoot, root) || !bytes.Equal(second.OldRoot, first.NewRoot) {
+		t.Fatal("batches do not chain from the initial root")
+	}
+	for k, want := range []TxType{TxTransfer, TxTransfer, TxTransfer, TxCollectFees} {
+		if first.Data[k].Type != want {
+			t.Fatalf("first batch slot %d is %v, want %v", k, first.Data[k].Type, want)
+		}
+	}
+	if second.Data[0].Type != TxTransfer || second.Data[1].Type != TxCollectFees || second.Data[3].Type != TxNoop {
+		t.Fatal("second batch is not the last transfer padded after the timeout")
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, _ := op.Root(); !bytes.Equal(got, second.NewRoot) || pool.Len() != 0 {
+		t.Fatal("operator or mempool does not reflect the published batches")
+	}
+}
+
+func TestSequencerStops(t *testing.T) {
+	op, privs := newBatchOperator(t, 8)
+	pool := NewMempool(op, cmimc.NewMiMC())
+
+	// cancellation
+	s, _ := solvingSequencer(t, op, pool, SequencerConfig{BatchSize: 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+	cancel()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// a failing sink
+	failed := errors.New("L1 unavailable")
+	s, err := NewSequencer(op, pool, nil, nil, SinkFunc(func(context.Context, BatchResult) error {
+		return failed
+	}), SequencerConfig{BatchSize: 2, Timeout: time.Millisecond})
+	if err != nil {
+		t.Fatalf("sequencer: %v", err)
+	}
+	s.prove = func(frontend.Circuit) (groth16.Proof, witness.Witness, error) { return nil, nil, nil }
+	if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 1, 0)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := s.Run(context.Background()); !errors.Is(err, failed) {
+		t.Fatalf("expected the sink's error, got %v", err)
+	}
+
+	if _, err := NewSequencer(op, pool, nil, nil, nil, SequencerConfig{BatchSize: 1}); !errors.Is(err, ErrSequencerBatchSize) {
+		t.Fatalf("expected ErrSequencerBatchSize, got %v", err)
+	}
+}
+
+func TestSequencerResumesUnpublishedBatches(t *testing.T) {
+	dir := t.TempDir()
+	store, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	op, privs := newBatchOperator(t, 8)
+	if err := store.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	cfg := SequencerConfig{BatchSize: 2, Timeout: time.Millisecond, FirstBatch: 3, Store: store}
+	pool := NewMempool(op, cmimc.NewMiMC())
+	s, results := solvingSequencer(t, op, pool, cfg)
+
+	// cancel while the batch is proving: it is committed, never published
+	ctx, cancel := context.WithCancel(context.Background())
+	proving := make(chan struct{})
+	s.prove = func(frontend.Circuit) (groth16.Proof, witness.Witness, error) {
+		close(proving)
+		<-ctx.Done()
+		return nil, nil, nil
+	}
+	if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 1, 0)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+	<-proving
+	cancel()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatal("a batch was published after the cancellation")
+	}
+	committed, _ := op.Root()
+
+	// a sequencer over the reopened store publishes it first
+	store.Close()
+	store, op, err = OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	cfg.Store = store
+	cfg.SnapshotEvery = 1
+	s, results = solvingSequencer(t, op, NewMempool(op, cmimc.NewMiMC()), cfg)
+	if s.next != 4 {
+		t.Fatalf("next batch %d after reopening, want 4", s.next)
+	}
+	runErr = make(chan error, 1)
+	go func() { runErr <- s.Run(context.Background()) }()
+	r := nextResult(t, results)
+	if r.Number != 3 || !bytes.Equal(r.NewRoot, committed) {
+		t.Fatalf("published batch %d, want the unpublished batch 3", r.Number)
+	}
+	// the published batch is snapshotted out of the log while running
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(time.Millisecond) {
+		if fi, err := os.Stat(filepath.Join(dir, walFile)); err == nil && fi.Size() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log still holds the published batch")
+		}
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if u := store.Unpublished(); len(u) != 0 {
+		t.Fatalf("%d batches still unpublished", len(u))
+	}
+}
+
+func TestSequencerRestartKeepsNumbering(t *testing.T) {
+	dir := t.TempDir()
+	store, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	op, privs := newBatchOperator(t, 8)
+	if err := store.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	cfg := SequencerConfig{BatchSize: 2, Timeout: time.Millisecond, PollInterval: time.Millisecond, FirstBatch: 3, Store: store}
+	pool := NewMempool(op, cmimc.NewMiMC())
+	s, results := solvingSequencer(t, op, pool, cfg)
+	if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 1, 0)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(context.Background()) }()
+	if r := nextResult(t, results); r.Number != 3 {
+		t.Fatalf("published batch %d, want 3", r.Number)
+	}
+	// let the sequencer poll the empty pool for batch 4 before it stops
+	time.Sleep(20 * cfg.PollInterval)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if n := op.BatchNumber(); n != 3 {
+		t.Fatalf("operator batch number %d after shutdown, want the last sealed 3", n)
+	}
+
+	// the batch after the restart follows the last published one
+	store.Close()
+	store, op, err = OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	cfg.Store = store
+	pool = NewMempool(op, cmimc.NewMiMC())
+	s, results = solvingSequencer(t, op, pool, cfg)
+	if s.next != 4 {
+		t.Fatalf("next batch %d after a clean restart, want 4", s.next)
+	}
+	if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 1, 1)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	runErr = make(chan error, 1)
+	go func() { runErr <- s.Run(context.Background()) }()
+	if r := nextResult(t, results); r.Number != 4 || r.Public.BatchNumber != 4 {
+		t.Fatalf("published batch %d after the restart, want 4", r.Number)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+func TestSequencerProvesBatches(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping sequencer proving in -short mode")
+	}
+	dir := t.TempDir()
+	store, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	op, privs := newBatchOperator(t, 4)
+	if err := store.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	ccs, err := prove.Compile(New(2, StateDepth+1))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	keys, err := prove.Setup(ccs)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	pool := NewMempool(op, cmimc.NewMiMC())
+	results := make(chan BatchResult, 1)
+	s, err := NewSequencer(op, pool, ccs, keys.PK, SinkFunc(func(_ context.Context, r BatchResult) error {
+		results <- r
+		return nil
+	}), SequencerConfig{BatchSize: 2, Timeout: time.Millisecond, Store: store})
+	if err != nil {
+		t.Fatalf("sequencer: %v", err)
+	}
+	if err := pool.Add(signedTransfer(t, op, privs, 0, 1, 5, 0)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(context.Background()) }()
+
+	r := nextResult(t, results)
+	if err := prove.Verify(r.Proof, keys.VK, r.PublicWitness); err != nil {
+		t.Fatalf("published proof does not verify: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	// the batch was committed before it was published
+	store.Close()
+	store, reopened, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if root, _ := reopened.Root(); !bytes.Equal(root, r.NewRoot) {
+		t.Fatal("store does not hold the published batch")
+	}
+}
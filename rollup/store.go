@@ -0,0 +1,443 @@
+package rollup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	chash "github.com/consensys/gnark-crypto/hash"
+)
+
+// ErrCorruptState is returned when a state directory's snapshot is unreadable,
+// does not hash to the root it records (for example when it is reopened with
+// another hash suite), or was written for another Domain or Authorizer than
+// the options it is reopened with.
+var ErrCorruptState = errors.New("rollup: corrupt state snapshot")
+
+// ErrEmptyCommit is returned when committing a batch without witnesses.
+var ErrEmptyCommit = errors.New("rollup: committed batch holds no transactions")
+
+// ErrStoreFailed is returned by a Store whose log could not be restored after a
+// failed write. It refuses to commit or snapshot until it is reopened.
+var ErrStoreFailed = errors.New("rollup: store log could not be restored after a failed write")
+
+// File names inside a state directory.
+const (
+	snapshotFile  = "snapshot"
+	walFile       = "wal"
+	publishedFile = "published"
+)
+
+// snapshotMagic starts every snapshot file.
+var snapshotMagic = []byte("ZKRS\x04")
+
+// Store persists an operator's state in a directory, so it survives a restart
+// or a crash. The directory holds a snapshot of the whole state (its settings
+// and its non-empty accounts), an
+// append-only write-ahead log (WAL) of the batches committed after it or not
+// yet published, and the sequence number of the last published batch. Each log
+// record holds the batch's witnesses with a sequence number, the batch number
+// and a checksum. The operator's batch number (see Operator.SetBatchNumber) is
+// restored with the state.
+//
+// Commit makes a batch durable; OpenStore reopens to the last committed batch,
+// loading the snapshot and replaying the log. A batch applied in memory but not
+// committed, or whose record was only partly written when the process died, is
+// not part of the reopened state. A committed batch stays in Unpublished, and
+// in the log, until MarkPublished covers it, so a batch committed but never
+// proven or published can be proven after a restart. Snapshot compacts the
+// log down to those batches.
+//
+// Commit and Snapshot are called by the writer that applies batches;
+// Unpublished and MarkPublished may be called concurrently with them.
+type Store struct {
+	dir string
+
+	mu          sync.Mutex // guards the fields below
+	wal         logFile
+	seq         uint64           // sequence number of the last committed batch
+	published   uint64           // sequence number of the last published batch
+	unpublished []CommittedBatch // committed and not published, in order
+	failed      bool             // the log could not be restored, see ErrStoreFailed
+}
+
+// logFile is the part of *os.File the store's log is accessed through.
+type logFile interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// CommittedBatch is a batch committed to a Store, as Unpublished returns it.
+type CommittedBatch struct {
+	Seq       uint64 // position in the store, see Store.MarkPublished
+	Number    uint64 // batch number, see Operator.SetBatchNumber
+	Witnesses []TransferWitness
+}
+
+// OpenStore opens the state directory dir, creating it if needed, and returns
+// the store with the operator it holds. A new directory holds
+// NewOperator(h, opts...); call Snapshot once its genesis accounts are added.
+// An existing directory is reopened at its last committed batch, with h and
+// opts as it was written with.
+func OpenStore(dir string, h chash.StateStorer, opts ...Option) (*Store, *Operator, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+	s := &Store{dir: dir}
+	op, err := s.loadSnapshot(h, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.loadPublished(); err != nil {
+		return nil, nil, err
+	}
+	if s.wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return nil, nil, err
+	}
+	if err := s.replay(op); err != nil {
+		s.wal.Close()
+		return nil, nil, err
+	}
+	return s, op, nil
+}
+
+// Commit durably appends a batch applied on the store's operator, given by its
+// witnesses in order. Once it returns nil, the batch survives a crash. If it
+// fails, the batch is not committed and the log is left as it was, so a later
+// Commit, for example of the same batch, is not lost behind a torn record; if
+// the log cannot be restored, the store fails with ErrStoreFailed from then on.
+func (s *Store) Commit(witnesses []TransferWitness) error {
+	if len(witnesses) == 0 {
+		return ErrEmptyCommit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return ErrStoreFailed
+	}
+	b := CommittedBatch{Seq: s.seq + 1, Number: witnesses[0].BatchNumber, Witnesses: witnesses}
+	rec, err := walRecord(b)
+	if err != nil {
+		return err
+	}
+	off, err := s.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = s.wal.Write(rec); err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		// replay stops at a torn record, and an unsynced one would be
+		// followed by a second record of the same sequence number
+		if s.cutLog(off) != nil {
+			s.failed = true
+		}
+		return err
+	}
+	s.seq++
+	s.unpublished = append(s.unpublished, b)
+	return nil
+}
+
+// Seq returns the sequence number of the last committed batch, 0 if none was.
+func (s *Store) Seq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// Unpublished returns the committed batches that MarkPublished does not cover
+// yet, in commit order.
+func (s *Store) Unpublished() []CommittedBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CommittedBatch(nil), s.unpublished...)
+}
+
+// MarkPublished durably records that the committed batches up to sequence
+// number seq are published, so they leave Unpublished and the next Snapshot
+// drops them from the log.
+func (s *Store) MarkPublished(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.published {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint64(nil, seq)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	if err := replaceFile(s.dir, publishedFile, b); err != nil {
+		return err
+	}
+	s.published = seq
+	for len(s.unpublished) > 0 && s.unpublished[0].Seq <= seq {
+		s.unpublished = s.unpublished[1:]
+	}
+	return nil
+}
+
+// Snapshot writes the whole state of op, which must be the store's operator
+// with every applied batch committed, and drops the published batches from the
+// log. Settings that are not batches, such as genesis accounts and the fee
+// collector, are durable only once snapshotted.
+func (s *Store) Snapshot(op *Operator) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return ErrStoreFailed
+	}
+	op.mu.RLock()
+	var b bytes.Buffer
+	b.Write(snapshotMagic)
+	binary.Write(&b, binary.BigEndian, s.seq)
+	b.Write(op.feeCollector[:])
+	for _, v := range []uint64{op.batchNumber, op.domain.ChainID, op.domain.InstanceID} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	fees := op.pendingFees.Bytes()
+	b.Write(fees[:])
+	b.Write(op.tree.root())
+	auth := op.auth.Name()
+	b.WriteByte(byte(len(auth)))
+	b.WriteString(auth)
+	for _, i := range slices.SortedFunc(maps.Keys(op.accounts), compareIndex) {
+		acc := op.accounts[i]
+		b.Write(acc.Serialize())
+	}
+	op.mu.RUnlock()
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(b.Bytes()))
+
+	// records the new snapshot already covers are only replayed if a crash
+	// leaves the old log in place, and then skipped by sequence number
+	if err := replaceFile(s.dir, snapshotFile, b.Bytes()); err != nil {
+		return err
+	}
+	var log []byte
+	for _, u := range s.unpublished {
+		rec, err := walRecord(u)
+		if err != nil {
+			return err
+		}
+		log = append(log, rec...)
+	}
+	if err := replaceFile(s.dir, walFile, log); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(filepath.Join(s.dir, walFile), os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := wal.Seek(0, io.SeekEnd); err != nil {
+		wal.Close()
+		return err
+	}
+	s.wal.Close()
+	s.wal = wal
+	return nil
+}
+
+// Close closes the log.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wal.Close()
+}
+
+// loadSnapshot returns the operator of the directory's snapshot, or a new one
+// if there is none.
+func (s *Store) loadSnapshot(h chash.StateStorer, opts []Option) (*Operator, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return NewOperator(h, opts...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const header = 8 + StateDepth/8 + 3*8 + fr.Bytes + fr.Bytes + 1
+	n := len(snapshotMagic)
+	if len(b) < n+header+4 || !bytes.Equal(b[:n], snapshotMagic) ||
+		crc32.ChecksumIEEE(b[:len(b)-4]) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return nil, ErrCorruptState
+	}
+	s.seq = binary.BigEndian.Uint64(b[n:])
+	var feeCollector Index
+	m := n + 8 + copy(feeCollector[:], b[n+8:])
+	batchNumber := binary.BigEndian.Uint64(b[m:])
+	domain := Domain{ChainID: binary.BigEndian.Uint64(b[m+8:]), InstanceID: binary.BigEndian.Uint64(b[m+16:])}
+	fees := b[m+24 : m+24+fr.Bytes]
+	root := b[m+24+fr.Bytes : n+header-1]
+	authEnd := n + header + int(b[n+header-1])
+	if authEnd > len(b)-4 {
+		return nil, ErrCorruptState
+	}
+	auth := string(b[n+header : authEnd])
+	state := b[authEnd : len(b)-4]
+	if len(state)%SizeAccount != 0 {
+		return nil, ErrCorruptState
+	}
+	// the deployment settings come from opts, as for the hash suite; a
+	// snapshot written under others would accept transactions it must not
+	if cfg := options(opts); domain != cfg.domain || auth != cfg.auth.Name() {
+		return nil, ErrCorruptState
+	}
+
+	op := NewOperator(h, opts...)
+	// the accounts are the non-empty ones, in increasing index order
+	var prev Index
+	for i := 0; i < len(state); i += SizeAccount {
+		acc, err := Deserialize(state[i : i+SizeAccount])
+		if err != nil || acc.IsEmpty() || (i > 0 && compareIndex(acc.Index, prev) <= 0) {
+			return nil, ErrCorruptState
+		}
+		prev = acc.Index
+		op.indexKey(acc.PubKey, acc.Index)
+		op.writeAccount(acc)
+	}
+	op.feeCollector = feeCollector
+	op.batchNumber = batchNumber
+	op.pendingFees.SetBytes(fees)
+	if !bytes.Equal(op.tree.root(), root) {
+		return nil, ErrCorruptState
+	}
+	return op, nil
+}
+
+// loadPublished reads the sequence number of the last published batch, 0 if
+// none was.
+func (s *Store) loadPublished() error {
+	b, err := os.ReadFile(filepath.Join(s.dir, publishedFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) != 12 || crc32.ChecksumIEEE(b[:8]) != binary.BigEndian.Uint32(b[8:]) {
+		return ErrCorruptState
+	}
+	s.published = binary.BigEndian.Uint64(b)
+	return nil
+}
+
+// replay applies the log's records past the snapshot to op and collects those
+// not published. A torn or corrupt record ends the log: it and anything after
+// it are cut off, as that batch was never committed. A record that does not
+// lead op to the root its last witness ends on fails with ErrCorruptState.
+func (s *Store) replay(op *Operator) error {
+	b, err := io.ReadAll(s.wal)
+	if err != nil {
+		return err
+	}
+	off := 0
+	for len(b)-off >= walHeader {
+		seq := binary.BigEndian.Uint64(b[off:])
+		batchNumber := binary.BigEndian.Uint64(b[off+8:])
+		n := int(binary.BigEndian.Uint32(b[off+16:]))
+		end := off + walHeader + n + 4
+		if end > len(b) || crc32.ChecksumIEEE(b[off:end-4]) != binary.BigEndian.Uint32(b[end-4:]) {
+			break
+		}
+		var ws []TransferWitness
+		if seq > s.seq || seq > s.published {
+			if err := gob.NewDecoder(bytes.NewReader(b[off+walHeader : end-4])).Decode(&ws); err != nil || len(ws) == 0 {
+				return ErrCorruptState
+			}
+		}
+		if seq > s.seq {
+			if err := op.Replay(BatchData(ws)); err != nil {
+				return err
+			}
+			if root, _ := op.Root(); !bytes.Equal(root, ws[len(ws)-1].RootAfter) {
+				return ErrCorruptState
+			}
+			op.SetBatchNumber(batchNumber)
+			s.seq = seq
+		}
+		if seq > s.published {
+			s.unpublished = append(s.unpublished, CommittedBatch{Seq: seq, Number: batchNumber, Witnesses: ws})
+		}
+		off = end
+	}
+	return s.cutLog(int64(off))
+}
+
+// cutLog truncates the log to size bytes and moves its offset there.
+func (s *Store) cutLog(size int64) error {
+	if err := s.wal.Truncate(size); err != nil {
+		return err
+	}
+	_, err := s.wal.Seek(size, io.SeekStart)
+	return err
+}
+
+// walHeader is the size of a log record's header: sequence number, batch
+// number and data length.
+const walHeader = 8 + 8 + 4
+
+// walRecord frames a committed batch as a log record: sequence number, batch
+// number, length, the gob-encoded witnesses, then a CRC-32 of all of it. The
+// witnesses, unlike the published data, are enough to prove the batch again.
+func walRecord(b CommittedBatch) ([]byte, error) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(b.Witnesses); err != nil {
+		return nil, err
+	}
+	rec := make([]byte, walHeader, walHeader+data.Len()+4)
+	binary.BigEndian.PutUint64(rec, b.Seq)
+	binary.BigEndian.PutUint64(rec[8:], b.Number)
+	binary.BigEndian.PutUint32(rec[16:], uint32(data.Len()))
+	rec = append(rec, data.Bytes()...)
+	return binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec)), nil
+}
+
+// replaceFile writes b to the file name in dir through a temporary file and a
+// rename, so a crash leaves either the old or the new file whole.
+func replaceFile(dir, name string, b []byte) error {
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync writes b to a new file at path and flushes it to disk.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes a directory entry change (a rename) to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,359 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+)
+
+// reopen closes s and opens its directory again.
+func reopen(t *testing.T, s *Store, dir string) (*Store, *Operator) {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	s, op, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	return s, op
+}
+
+func TestStoreReopensCommittedState(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newGenesis(t)
+	collector := indexOf(t, op, privs[2])
+	if err := op.SetFeeCollector(collector); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := s.Commit(buildMixedBatch(t, op, privs)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// applied but never committed: lost on reopen
+	applyTransfers(t, op, privs, 1)
+
+	s, got := reopen(t, s, dir)
+	want, _ := newGenesis(t)
+	if err := want.SetFeeCollector(collector); err != nil {
+		t.Fatalf("fee collector: %v", err)
+	}
+	buildMixedBatch(t, want, privs)
+	assertSameState(t, got, want)
+
+	// compact, then log one more batch on top of the new snapshot
+	if err := s.Snapshot(got); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := s.Commit(applyTransfers(t, got, privs, 2)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	applyTransfers(t, want, privs, 2)
+	s, got = reopen(t, s, dir)
+	defer s.Close()
+	assertSameState(t, got, want)
+	if got.feeCollector != collector {
+		t.Fatalf("fee collector %d after reopen, want %d", got.feeCollector, collector)
+	}
+}
+
+func TestStoreReopensBatchNumber(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	op.SetBatchNumber(4)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	s, got := reopen(t, s, dir)
+	if n := got.BatchNumber(); n != 4 {
+		t.Fatalf("batch number %d after reopening the snapshot, want 4", n)
+	}
+
+	got.SetBatchNumber(5)
+	if err := s.Commit(applyTransfers(t, got, privs, 1)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s, got = reopen(t, s, dir)
+	defer s.Close()
+	if n := got.BatchNumber(); n != 5 {
+		t.Fatalf("batch number %d after replaying the log, want 5", n)
+	}
+	if err := s.Commit(nil); !errors.Is(err, ErrEmptyCommit) {
+		t.Fatalf("expected ErrEmptyCommit, got %v", err)
+	}
+}
+
+func TestStoreKeepsUnpublishedBatches(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	var batches [][]TransferWitness
+	for n := uint64(1); n <= 2; n++ {
+		op.SetBatchNumber(n)
+		w := applyTransfers(t, op, privs, 1)
+		if err := s.Commit(w); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		batches = append(batches, w)
+	}
+	if err := s.MarkPublished(1); err != nil {
+		t.Fatalf("mark published: %v", err)
+	}
+
+	// the unpublished batch survives a reopen and a snapshot, with the
+	// witnesses needed to prove it
+	for k := 0; k < 2; k++ {
+		var got *Operator
+		s, got = reopen(t, s, dir)
+		u := s.Unpublished()
+		if len(u) != 1 || u[0].Seq != 2 || u[0].Number != 2 || !reflect.DeepEqual(u[0].Witnesses, batches[1]) {
+			t.Fatalf("reopen %d: unpublished batches %+v, want batch 2", k, u)
+		}
+		if err := s.Snapshot(got); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+	}
+
+	if err := s.MarkPublished(2); err != nil {
+		t.Fatalf("mark published: %v", err)
+	}
+	s, got := reopen(t, s, dir)
+	defer s.Close()
+	if u := s.Unpublished(); len(u) != 0 {
+		t.Fatalf("%d unpublished batches after publishing all", len(u))
+	}
+	if root, _ := got.Root(); !bytes.Equal(root, batches[1][0].RootAfter) || s.Seq() != 2 {
+		t.Fatal("reopened store is not at the last committed batch")
+	}
+}
+
+func TestStoreDropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := s.Commit(applyTransfers(t, op, privs, 1)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	committed, _ := op.Root()
+
+	// the first half of the next record, as a crash mid-write leaves it
+	rec, err := walRecord(CommittedBatch{Seq: 2, Witnesses: applyTransfers(t, op, privs, 1)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := s.wal.Write(rec[:len(rec)/2]); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	s, got := reopen(t, s, dir)
+	if root, _ := got.Root(); !bytes.Equal(root, committed) {
+		t.Fatal("reopened state is not the last committed batch")
+	}
+	// the torn tail is cut off, so the log accepts new batches
+	w := applyTransfers(t, got, privs, 1)
+	if err := s.Commit(w); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s, got = reopen(t, s, dir)
+	defer s.Close()
+	if root, _ := got.Root(); !bytes.Equal(root, w[0].RootAfter) {
+		t.Fatal("batch committed after recovery is missing")
+	}
+}
+
+// errInjected is the failure faultyLog injects.
+var errInjected = errors.New("injected log failure")
+
+// faultyLog fails the next Write after writing half of it, the next Sync or
+// every Truncate, as its flags say.
+type faultyLog struct {
+	logFile
+	tearWrite, failSync, failTruncate bool
+}
+
+func (f *faultyLog) Write(b []byte) (int, error) {
+	if f.tearWrite {
+		f.tearWrite = false
+		n, _ := f.logFile.Write(b[:len(b)/2])
+		return n, errInjected
+	}
+	return f.logFile.Write(b)
+}
+
+func (f *faultyLog) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errInjected
+	}
+	return f.logFile.Sync()
+}
+
+func (f *faultyLog) Truncate(size int64) error {
+	if f.failTruncate {
+		return errInjected
+	}
+	return f.logFile.Truncate(size)
+}
+
+func TestStoreRollsBackFailedCommit(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	log := &faultyLog{logFile: s.wal}
+	s.wal = log
+
+	// a torn write and a failed sync commit nothing; retrying commits the batch
+	for _, fault := range []*bool{&log.tearWrite, &log.failSync} {
+		w := applyTransfers(t, op, privs, 1)
+		*fault = true
+		if err := s.Commit(w); !errors.Is(err, errInjected) {
+			t.Fatalf("expected the injected failure, got %v", err)
+		}
+		if err := s.Commit(w); err != nil {
+			t.Fatalf("commit after a failure: %v", err)
+		}
+	}
+	if got := s.Seq(); got != 2 {
+		t.Fatalf("store at sequence number %d after two batches, want 2", got)
+	}
+
+	s, got := reopen(t, s, dir)
+	assertSameState(t, got, op)
+	unpublished := s.Unpublished()
+	if len(unpublished) != 2 || unpublished[0].Seq != 1 || unpublished[1].Seq != 2 {
+		t.Fatalf("reopened log holds %d batches, want sequence numbers 1 and 2", len(unpublished))
+	}
+
+	// a log that cannot be cut back fails the store
+	s.wal = &faultyLog{logFile: s.wal, tearWrite: true, failTruncate: true}
+	w := applyTransfers(t, got, privs, 1)
+	if err := s.Commit(w); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if err := s.Commit(w); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected ErrStoreFailed, got %v", err)
+	}
+	if err := s.Snapshot(got); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected ErrStoreFailed from Snapshot, got %v", err)
+	}
+	s.Close()
+}
+
+func TestStoreRejectsDivergentLog(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	// a well-formed record whose data does not lead to the root it claims
+	w := applyTransfers(t, op, privs, 1)
+	w[0].RootAfter = w[0].RootBefore
+	if err := s.Commit(w); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s.Close()
+
+	if _, _, err := OpenStore(dir, cmimc.NewMiMC()); !errors.Is(err, ErrCorruptState) {
+		t.Fatalf("expected ErrCorruptState for a log that diverges from its roots, got %v", err)
+	}
+}
+
+func TestStoreRejectsCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, _ := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	s.Close()
+
+	if _, _, err := OpenStore(dir, Poseidon2.New()); !errors.Is(err, ErrCorruptState) {
+		t.Fatalf("expected ErrCorruptState reopening with another hash suite, got %v", err)
+	}
+	for name, opt := range map[string]Option{
+		"domain":     WithDomain(Domain{ChainID: 1}),
+		"authorizer": WithAuthorizer(Schnorr{}),
+	} {
+		if _, _, err := OpenStore(dir, cmimc.NewMiMC(), opt); !errors.Is(err, ErrCorruptState) {
+			t.Fatalf("expected ErrCorruptState reopening with another %s, got %v", name, err)
+		}
+	}
+	reopened, _, err := OpenStore(dir, cmimc.NewMiMC(), WithAuthorizer(EdDSA{}))
+	if err != nil {
+		t.Fatalf("reopen with the snapshot's settings: %v", err)
+	}
+	reopened.Close()
+	path := filepath.Join(dir, snapshotFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	b[len(b)/2] ^= 1
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := OpenStore(dir, cmimc.NewMiMC()); !errors.Is(err, ErrCorruptState) {
+		t.Fatalf("expected ErrCorruptState for a flipped bit, got %v", err)
+	}
+}
+
+// assertSameState fails unless got and want hold the same accounts, root and
+// uncollected fees.
+func assertSameState(t *testing.T, got, want *Operator) {
+	t.Helper()
+	if !maps.Equal(got.accounts, want.accounts) {
+		t.Fatal("reopened accounts differ")
+	}
+	gotRoot, _ := got.Root()
+	wantRoot, _ := want.Root()
+	if !bytes.Equal(gotRoot, wantRoot) {
+		t.Fatal("reopened root differs")
+	}
+	if !got.pendingFees.Equal(&want.pendingFees) {
+		t.Fatal("reopened pending fees differ")
+	}
+	if len(got.accountMap) != len(want.accountMap) {
+		t.Fatalf("reopened %d indexed keys, want %d", len(got.accountMap), len(want.accountMap))
+	}
+}
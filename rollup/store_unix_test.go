@@ -0,0 +1,121 @@
+//go:build unix
+
+package rollup
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+)
+
+// crashDirEnv makes the test binary run TestStoreRecoversFromKill as the child
+// process that writes the store in that directory; crashModeEnv selects how the
+// child dies.
+const (
+	crashDirEnv  = "ROLLUP_STORE_CRASH_DIR"
+	crashModeEnv = "ROLLUP_STORE_CRASH_MODE"
+)
+
+// TestStoreRecoversFromKill runs a child process that commits batches of one
+// transfer until it is killed with SIGKILL, and checks that the directory it
+// leaves reopens to its last committed batch. In "torn" mode the child kills
+// itself halfway through writing a record; otherwise the parent kills it at
+// whatever point it has reached.
+func TestStoreRecoversFromKill(t *testing.T) {
+	if dir := os.Getenv(crashDirEnv); dir != "" {
+		crashChild(t, dir, os.Getenv(crashModeEnv))
+		return
+	}
+	for _, mode := range []string{"torn", "kill"} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestStoreRecoversFromKill$") //#nosec G204 -- re-runs the test binary
+			cmd.Env = append(os.Environ(), crashDirEnv+"="+dir, crashModeEnv+"="+mode)
+			out, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatalf("pipe: %v", err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+
+			// roots the child reports: committed after Commit returned, applied
+			// once the batch is in memory but before it is committed
+			var committed, applied string
+			commits := 0
+			scanner := bufio.NewScanner(out)
+			for scanner.Scan() {
+				tag, root, ok := strings.Cut(scanner.Text(), " ")
+				switch {
+				case !ok:
+				case tag == "committed":
+					committed, applied = root, ""
+					if commits++; commits == 5 && mode == "kill" {
+						_ = cmd.Process.Kill()
+					}
+				case tag == "applied":
+					applied = root
+				}
+			}
+			err = cmd.Wait()
+			var exit *exec.ExitError
+			if !errors.As(err, &exit) || exit.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+				t.Fatalf("child was not killed: %v", err)
+			}
+			if commits < 3 {
+				t.Fatalf("child committed %d batches before dying", commits)
+			}
+
+			s, op, err := OpenStore(dir, cmimc.NewMiMC())
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer s.Close()
+			root, _ := op.Root()
+			got := hex.EncodeToString(root)
+			// a kill between a durable Commit and its report leaves the applied batch
+			if got != committed && (mode == "torn" || got != applied) {
+				t.Fatalf("reopened at root %s, want last committed %s", got, committed)
+			}
+		})
+	}
+}
+
+// crashChild is the child side of TestStoreRecoversFromKill. It never returns.
+func crashChild(t *testing.T, dir, mode string) {
+	s, _, err := OpenStore(dir, cmimc.NewMiMC())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	op, privs := newBatchOperator(t, 16)
+	if err := s.Snapshot(op); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	for k := 0; ; k++ {
+		w := applyTransfers(t, op, privs, 1)
+		fmt.Printf("applied %x\n", w[0].RootAfter)
+		if mode == "torn" && k == 3 {
+			rec, err := walRecord(CommittedBatch{Seq: uint64(k + 1), Witnesses: w})
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if _, err := s.wal.Write(rec[:len(rec)/2]); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			_ = syscall.Kill(os.Getpid(), syscall.SIGKILL)
+			select {}
+		}
+		if err := s.Commit(w); err != nil {
+			t.Fatalf("commit %d: %v", k, err)
+		}
+		fmt.Printf("committed %x\n", w[0].RootAfter)
+	}
+}
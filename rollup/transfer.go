@@ -3,6 +3,7 @@ package rollup
 import (
 	"errors"
 	"hash"
+	"math"
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
@@ -11,78 +12,161 @@ import (
 // ErrWrongSignature is returned when a transfer's signature does not verify.
 var ErrWrongSignature = errors.New("rollup: invalid transfer signature")
 
-// Transfer is a signed value transfer between two accounts. The signature is
-// over the MiMC hash of (nonce || amount || senderPubKey || receiverPubKey).
+// ErrTransferExpired is returned when a transfer is applied in a batch past its
+// ValidUntil.
+var ErrTransferExpired = errors.New("rollup: transfer is past its valid-until batch")
+
+// NoExpiry is the ValidUntil of a transfer that stays valid until its nonce is
+// used.
+const NoExpiry uint64 = math.MaxUint64
+
+// ErrWrongDomain is returned when a transaction is signed for another Domain
+// than the operator's.
+var ErrWrongDomain = errors.New("rollup: transaction signed for another domain")
+
+// Domain identifies the rollup deployment a transaction is signed for. Every
+// signed message starts with the transaction's type tag and its domain, so a
+// signature made for one deployment, or for a testnet sharing the keys, is
+// invalid on every other, and a signature for one type of transaction never
+// verifies as another.
+type Domain struct {
+	ChainID    uint64 // the L1 chain the rollup settles on
+	InstanceID uint64 // the rollup instance on that chain
+}
+
+// elements returns the separator of a message of type typ signed for d: typ,
+// ChainID and InstanceID.
+func (d Domain) elements(typ TxType) []fr.Element {
+	var e [3]fr.Element
+	e[0].SetUint64(uint64(typ))
+	e[1].SetUint64(d.ChainID)
+	e[2].SetUint64(d.InstanceID)
+	return e[:]
+}
+
+// TxType tags what one slot of a batch does. It is carried in the witness and
+// constrained in-circuit, so every slot of a compiled batch can hold any type.
+type TxType uint64
+
+// Transaction types.
+const (
+	// TxTransfer is a signed value transfer between two accounts.
+	TxTransfer TxType = iota
+	// TxNoop is a padding slot: the state is unchanged and no signature is
+	// required. It lets a batch with fewer transfers than the compiled batch
+	// size be proven with the same keys.
+	TxNoop
+	// TxDeposit credits an account (created in an empty slot if needed) with
+	// value from L1; see Deposit.
+	TxDeposit
+	// TxWithdrawal debits a signed amount from an account and pays it out on
+	// L1; see Withdrawal.
+	TxWithdrawal
+	// TxCreate registers a new account: an empty leaf is replaced by an
+	// account with a given key, zero balance and zero nonce.
+	TxCreate
+	// TxCollectFees credits the fee collector with the fees charged by the
+	// batch's transfers. Every batch that charges fees settles them this way.
+	TxCollectFees
+)
+
+// signed reports whether slots of this type carry the sender's signature.
+func (t TxType) signed() bool {
+	return t == TxTransfer || t == TxWithdrawal
+}
+
+// Transfer is a signed value transfer of Amount of token TokenID between two
+// accounts. The signature is over the hash of (TxTransfer || domain || nonce ||
+// tokenID || amount || fee || validUntil || senderPubKey || receiverPubKey).
+// Fee is optional (zero by default); it is charged to the sender in FeeToken,
+// on top of Amount, and paid to the operator's fee collector.
+//
+// ValidUntil is the number of the last batch that may include the transfer, so
+// a transfer that was not included in time never will be.
 type Transfer struct {
+	Domain         Domain // the deployment the transfer is signed for
 	Nonce          uint64
+	ValidUntil     uint64
+	TokenID        uint64
 	Amount         fr.Element
+	Fee            fr.Element
 	SenderPubKey   eddsa.PublicKey
 	ReceiverPubKey eddsa.PublicKey
 
-	// Signature holds the parsed signature and its raw serialized bytes. The raw
-	// bytes are kept for assigning the in-circuit witness.
-	Signature    eddsa.Signature
+	// SignatureRaw is the serialized signature under the rollup's Authorizer.
+	// It is kept for assigning the in-circuit witness.
 	SignatureRaw []byte
 }
 
-// NewTransfer creates an unsigned transfer.
+// NewTransfer creates an unsigned transfer of FeeToken for the zero Domain that
+// never expires. Set TokenID, Domain and ValidUntil before signing to move
+// another token, to sign for another deployment or to bound the batches that
+// may include it.
 func NewTransfer(amount uint64, from, to eddsa.PublicKey, nonce uint64) Transfer {
 	var t Transfer
 	t.Nonce = nonce
+	t.ValidUntil = NoExpiry
 	t.Amount.SetUint64(amount)
 	t.SenderPubKey = from
 	t.ReceiverPubKey = to
 	return t
 }
 
-// preimage returns the message that is signed/verified: the MiMC hash of
-// nonce || amount || senderX || senderY || receiverX || receiverY.
-func (t *Transfer) preimage(h hash.Hash) []byte {
-	h.Reset()
-
-	var n fr.Element
-	n.SetUint64(t.Nonce)
-	nb := n.Bytes()
-	h.Write(nb[:])
+// NewTransferWithFee creates an unsigned transfer that also pays fee to the fee
+// collector.
+func NewTransferWithFee(amount, fee uint64, from, to eddsa.PublicKey, nonce uint64) Transfer {
+	t := NewTransfer(amount, from, to, nonce)
+	t.Fee.SetUint64(fee)
+	return t
+}
 
-	ab := t.Amount.Bytes()
-	h.Write(ab[:])
+// preimage returns the message that is signed/verified: the hash of
+// TxTransfer || chainID || instanceID || nonce || tokenID || amount || fee ||
+// validUntil || senderX || senderY || receiverX || receiverY.
+func (t *Transfer) preimage(h hash.Hash) []byte {
+	elems := append(t.Domain.elements(TxTransfer), toElem(t.Nonce), toElem(t.TokenID), t.Amount, t.Fee, toElem(t.ValidUntil),
+		t.SenderPubKey.A.X, t.SenderPubKey.A.Y, t.ReceiverPubKey.A.X, t.ReceiverPubKey.A.Y)
+	m := hashElements(h, elems...)
+	return m.Marshal()
+}
 
-	sx := t.SenderPubKey.A.X.Bytes()
-	h.Write(sx[:])
-	sy := t.SenderPubKey.A.Y.Bytes()
-	h.Write(sy[:])
+// Sign signs the transfer with priv under EdDSA and stores the signature on the
+// transfer. It returns the raw signature bytes. h must be a hasher of the
+// rollup's HashSuite.
+func (t *Transfer) Sign(priv eddsa.PrivateKey, h hash.Hash) ([]byte, error) {
+	return t.SignWith(EdDSA{}, priv, h)
+}
 
-	rx := t.ReceiverPubKey.A.X.Bytes()
-	h.Write(rx[:])
-	ry := t.ReceiverPubKey.A.Y.Bytes()
-	h.Write(ry[:])
+// SignWith is Sign under the Authorizer a, which must be the rollup's.
+func (t *Transfer) SignWith(a Authorizer, priv eddsa.PrivateKey, h hash.Hash) ([]byte, error) {
+	return sign(a, priv, t.preimage(h), h, &t.SignatureRaw)
+}
 
-	return h.Sum(nil)
+// Verify checks the transfer's EdDSA signature against its sender public key.
+func (t *Transfer) Verify(h hash.Hash) (bool, error) {
+	return t.VerifyWith(EdDSA{}, h)
 }
 
-// Sign signs the transfer with priv and stores the signature on the transfer. It
-// returns the raw signature bytes. h must be the MiMC hasher used everywhere in
-// the rollup.
-func (t *Transfer) Sign(priv eddsa.PrivateKey, h hash.Hash) ([]byte, error) {
-	msg := t.preimage(h)
+// VerifyWith is Verify under the Authorizer a.
+func (t *Transfer) VerifyWith(a Authorizer, h hash.Hash) (bool, error) {
+	return verify(a, t.SenderPubKey, t.SignatureRaw, t.preimage(h), h)
+}
 
-	sigBytes, err := priv.Sign(msg, h)
+// sign signs msg with priv under a and stores the raw signature in raw,
+// returning it.
+func sign(a Authorizer, priv eddsa.PrivateKey, msg []byte, h hash.Hash, raw *[]byte) ([]byte, error) {
+	sigBytes, err := a.Sign(priv, msg, h)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := t.Signature.SetBytes(sigBytes); err != nil {
-		return nil, err
-	}
-	t.SignatureRaw = sigBytes
+	*raw = sigBytes
 	return sigBytes, nil
 }
 
-// Verify checks the transfer's signature against its sender public key.
-func (t *Transfer) Verify(h hash.Hash) (bool, error) {
-	msg := t.preimage(h)
-
-	ok, err := t.SenderPubKey.Verify(t.SignatureRaw, msg, h)
+// verify checks a raw signature over msg under a against pub, reporting a
+// mismatch as ErrWrongSignature.
+func verify(a Authorizer, pub eddsa.PublicKey, sigRaw, msg []byte, h hash.Hash) (bool, error) {
+	ok, err := a.Verify(pub, sigRaw, msg, h)
 	if err != nil {
 		return false, err
 	}
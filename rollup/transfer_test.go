@@ -1,6 +1,7 @@
 package rollup
 
 import (
+	"errors"
 	"math/rand"
 	"testing"
 
@@ -9,11 +10,11 @@ import (
 
 func TestTransferSignVerify(t *testing.T) {
 	r := rand.New(rand.NewSource(42)) //#nosec G404 -- deterministic test
-	sender, senderPriv, err := NewAccount(0, 100, r)
+	sender, senderPriv, err := NewAccount(100, r)
 	if err != nil {
 		t.Fatalf("sender: %v", err)
 	}
-	receiver, _, err := NewAccount(1, 100, r)
+	receiver, _, err := NewAccount(100, r)
 	if err != nil {
 		t.Fatalf("receiver: %v", err)
 	}
@@ -32,8 +33,8 @@ func TestTransferSignVerify(t *testing.T) {
 
 func TestTransferTamperFails(t *testing.T) {
 	r := rand.New(rand.NewSource(43)) //#nosec G404 -- deterministic test
-	sender, senderPriv, _ := NewAccount(0, 100, r)
-	receiver, _, _ := NewAccount(1, 100, r)
+	sender, senderPriv, _ := NewAccount(100, r)
+	receiver, _, _ := NewAccount(100, r)
 
 	h := cmimc.NewMiMC()
 	transfer := NewTransfer(10, sender.PubKey, receiver.PubKey, sender.Nonce)
@@ -52,3 +53,84 @@ func TestTransferTamperFails(t *testing.T) {
 		t.Fatal("expected an error for tampered transfer")
 	}
 }
+
+func TestTransferTokenIsSigned(t *testing.T) {
+	r := rand.New(rand.NewSource(44)) //#nosec G404 -- deterministic test
+	sender, senderPriv, _ := NewAccount(100, r)
+	receiver, _, _ := NewAccount(100, r)
+
+	h := cmimc.NewMiMC()
+	transfer := NewTransfer(10, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.TokenID = 1
+	if _, err := transfer.Sign(senderPriv, h); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	// A signature for one token must not move another.
+	transfer.TokenID = 2
+	if ok, _ := transfer.Verify(h); ok {
+		t.Fatal("transfer with a changed token should not verify")
+	}
+}
+
+func TestTransferDomainIsSigned(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+	domain := Domain{ChainID: 1, InstanceID: 2}
+
+	h := cmimc.NewMiMC()
+	transfer := NewTransfer(10, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.Domain = domain
+	if _, err := transfer.Sign(privs[0], h); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	// the signature is only valid for the domain it was made for
+	for _, other := range []Domain{{ChainID: 5, InstanceID: 2}, {ChainID: 1, InstanceID: 3}} {
+		replayed := transfer
+		replayed.Domain = other
+		if ok, _ := replayed.Verify(h); ok {
+			t.Fatalf("transfer signed for %+v verifies for %+v", domain, other)
+		}
+	}
+
+	if _, err := op.ApplyTransfer(transfer); !errors.Is(err, ErrWrongDomain) {
+		t.Fatalf("expected ErrWrongDomain from an operator of the zero domain, got %v", err)
+	}
+	op, _ = newTestOperator(t, 4, WithDomain(domain))
+	if _, err := op.ApplyTransfer(transfer); err != nil {
+		t.Fatalf("apply in the signed domain: %v", err)
+	}
+}
+
+func TestTransferExpires(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	sender := accountOf(t, op, privs[0])
+	receiver := accountOf(t, op, privs[1])
+
+	h := cmimc.NewMiMC()
+	transfer := NewTransfer(10, sender.PubKey, receiver.PubKey, sender.Nonce)
+	transfer.ValidUntil = 5
+	if _, err := transfer.Sign(privs[0], h); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	extended := transfer
+	extended.ValidUntil = 6
+	if ok, _ := extended.Verify(h); ok {
+		t.Fatal("transfer with an extended ValidUntil should not verify")
+	}
+
+	op.SetBatchNumber(6)
+	if _, err := op.ApplyTransfer(transfer); !errors.Is(err, ErrTransferExpired) {
+		t.Fatalf("expected ErrTransferExpired, got %v", err)
+	}
+	op.SetBatchNumber(5)
+	w, err := op.ApplyTransfer(transfer)
+	if err != nil {
+		t.Fatalf("apply in its last batch: %v", err)
+	}
+	if w.BatchNumber != 5 || w.ValidUntil != 5 {
+		t.Fatalf("witness records batch %d, valid until %d", w.BatchNumber, w.ValidUntil)
+	}
+}
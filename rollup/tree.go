@@ -0,0 +1,131 @@
+package rollup
+
+import (
+	"bytes"
+
+	chash "github.com/consensys/gnark-crypto/hash"
+)
+
+// merkleTree is the sparse Merkle tree over the operator's leaves: a full
+// binary tree of fixed depth whose leaf positions are account indices (see
+// KeyIndex), below 2^depth. It stores only the nodes that
+// differ from those of an empty tree, so its memory grows with the accounts
+// rather than with 2^depth, and a leaf update rehashes a single path while a
+// proof or the root is read in O(depth).
+//
+// An empty leaf holds the commitment of the empty account, an inner node is the
+// compression of its children (see compress), and empty[l] is the node of
+// height l over empty leaves only. gadget.MerklePath computes the same nodes
+// in-circuit.
+type merkleTree struct {
+	h     chash.StateStorer
+	empty [][]byte           // empty[0] is the empty leaf; empty[depth] the root of an empty tree
+	nodes []map[Index][]byte // nodes[l] holds the nodes of height l that are not empty[l], by position
+}
+
+// newMerkleTree returns a tree of the given depth, at most StateDepth, whose
+// leaves are all emptyLeaf.
+func newMerkleTree(h chash.StateStorer, depth int, emptyLeaf []byte) *merkleTree {
+	t := &merkleTree{
+		h:     h,
+		empty: [][]byte{append([]byte(nil), emptyLeaf...)},
+		nodes: make([]map[Index][]byte, depth+1),
+	}
+	for l := range t.nodes {
+		t.nodes[l] = make(map[Index][]byte)
+		if l > 0 {
+			t.empty = append(t.empty, compress(h, t.empty[l-1], t.empty[l-1]))
+		}
+	}
+	return t
+}
+
+// depth returns the number of levels above the leaves.
+func (t *merkleTree) depth() int {
+	return len(t.nodes) - 1
+}
+
+// node returns the node of height l at pos.
+func (t *merkleTree) node(l int, pos Index) []byte {
+	if n, ok := t.nodes[l][pos]; ok {
+		return n
+	}
+	return t.empty[l]
+}
+
+// root returns the root of the tree.
+func (t *merkleTree) root() []byte {
+	return t.node(t.depth(), Index{})
+}
+
+// update sets the leaf at pos and rehashes its path to the root.
+func (t *merkleTree) update(pos Index, leaf []byte) {
+	n := append([]byte(nil), leaf...)
+	t.set(0, pos, n)
+	for l := 1; l < len(t.nodes); l++ {
+		if s := t.node(l-1, pos.sibling()); pos.isRight() {
+			n = compress(t.h, s, n)
+		} else {
+			n = compress(t.h, n, s)
+		}
+		pos = pos.parent()
+		t.set(l, pos, n)
+	}
+}
+
+// set stores n as the node of height l at pos, or drops it if it is the empty
+// node.
+func (t *merkleTree) set(l int, pos Index, n []byte) {
+	if bytes.Equal(n, t.empty[l]) {
+		delete(t.nodes[l], pos)
+		return
+	}
+	t.nodes[l][pos] = n
+}
+
+// proof returns the Merkle path of the leaf at pos: the leaf itself followed by
+// its siblings from the leaf up.
+func (t *merkleTree) proof(pos Index) [][]byte {
+	path := [][]byte{t.node(0, pos)}
+	for l := 0; l < t.depth(); l++ {
+		path = append(path, t.node(l, pos.sibling()))
+		pos = pos.parent()
+	}
+	return path
+}
+
+// parent returns the position of the node above the one at i: i shifted right
+// by one bit.
+func (i Index) parent() Index {
+	var p Index
+	for k := len(i) - 1; k > 0; k-- {
+		p[k] = i[k]>>1 | i[k-1]<<7
+	}
+	p[0] = i[0] >> 1
+	return p
+}
+
+// sibling returns the position of the other child of i's parent.
+func (i Index) sibling() Index {
+	i[len(i)-1] ^= 1
+	return i
+}
+
+// isRight reports whether i is the right child of its parent.
+func (i Index) isRight() bool {
+	return i[len(i)-1]&1 == 1
+}
+
+// compress returns the node over left and right: h started from the state left
+// absorbs right, which costs one permutation where H(left || right) costs two.
+// For MiMC it is the Miyaguchi–Preneel step E_left(right) + left + right, for
+// Poseidon2 the width-2 compression function. Both are 32-byte canonical field
+// elements. The hasher is reset before use.
+func compress(h chash.StateStorer, left, right []byte) []byte {
+	h.Reset()
+	if err := h.SetState(left); err != nil {
+		panic(err) // nodes and balances are canonical field elements
+	}
+	h.Write(right)
+	return h.Sum(nil)
+}
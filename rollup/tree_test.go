@@ -0,0 +1,169 @@
+package rollup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	chash "github.com/consensys/gnark-crypto/hash"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/nodebreaker0-0/gnark-rollup-exp/gadget"
+)
+
+// rebuildProof is the reference the tree must match: the proof of the leaf at
+// pos in a tree of the given depth over leaves, computed from scratch one level
+// at a time, every node above empty leaves only being the node of an empty tree.
+func rebuildProof(h chash.StateStorer, depth int, leaves map[Index][]byte, emptyLeaf []byte, pos Index) MerkleProofData {
+	level, emptyNode := leaves, emptyLeaf
+	node := func(p Index) []byte {
+		if n, ok := level[p]; ok {
+			return n
+		}
+		return emptyNode
+	}
+	path := [][]byte{node(pos)}
+	for p, l := pos, 0; l < depth; p, l = p.parent(), l+1 {
+		path = append(path, node(p.sibling()))
+		next := make(map[Index][]byte)
+		for q := range level {
+			if q.isRight() {
+				q = q.sibling()
+			}
+			next[q.parent()] = compress(h, node(q), node(q.sibling()))
+		}
+		level, emptyNode = next, compress(h, emptyNode, emptyNode)
+	}
+	return MerkleProofData{RootHash: node(Index{}), Path: path, Index: pos}
+}
+
+// accountLeaves returns the leaves of o's non-empty accounts, by index.
+func accountLeaves(o *Operator) map[Index][]byte {
+	leaves := make(map[Index][]byte, len(o.accounts))
+	for i, acc := range o.accounts {
+		leaves[i] = acc.Hash(o.h)
+	}
+	return leaves
+}
+
+// verifyProof reports whether p proves its leaf, p.Path[0], under p.RootHash in
+// a tree of 2^(len(p.Path)-1) leaves.
+func verifyProof(h chash.StateStorer, p MerkleProofData) bool {
+	node, pos := p.Path[0], p.Index
+	for _, s := range p.Path[1:] {
+		if pos.isRight() {
+			node = compress(h, s, node)
+		} else {
+			node = compress(h, node, s)
+		}
+		pos = pos.parent()
+	}
+	return bytes.Equal(node, p.RootHash)
+}
+
+func TestMerkleTreeMatchesRebuild(t *testing.T) {
+	r := rand.New(rand.NewSource(5)) //#nosec G404 -- deterministic test
+	h := cmimc.NewMiMC()
+	var empty Account
+	empty.Reset()
+	emptyLeaf := empty.Hash(h)
+	for _, depth := range []int{1, 3, 8, 64, StateDepth} {
+		tree := newMerkleTree(h, depth, emptyLeaf)
+		leaves := make(map[Index][]byte)
+		leaf := func() Index {
+			var i Index
+			r.Read(i[:])
+			// keep the low depth bits
+			for b := 0; b < len(i)*8-depth; b++ {
+				i[b/8] &^= 0x80 >> (b % 8)
+			}
+			return i
+		}
+		var first Index
+		for k := 0; k < 16; k++ {
+			pos := leaf()
+			if k == 0 {
+				first = pos
+			}
+			var acc Account
+			acc.Reset()
+			acc.Nonce = uint64(k + 1)
+			acc.Balances[FeeToken].SetUint64(uint64(r.Int63()))
+			leaves[pos] = acc.Hash(h)
+			// emptying a leaf again drops its path from the tree
+			if k%3 == 2 {
+				delete(leaves, pos)
+				tree.update(pos, emptyLeaf)
+			} else {
+				tree.update(pos, leaves[pos])
+			}
+
+			for _, p := range []Index{pos, first, leaf()} {
+				got := tree.proof(p)
+				want := rebuildProof(h, depth, leaves, emptyLeaf, p)
+				if !bytes.Equal(tree.root(), want.RootHash) || len(got) != depth+1 {
+					t.Fatalf("depth %d leaf %s: tree proof differs from the rebuilt one", depth, p)
+				}
+				for i := range got {
+					if !bytes.Equal(got[i], want.Path[i]) {
+						t.Fatalf("depth %d leaf %s: path element %d differs", depth, p, i)
+					}
+				}
+			}
+		}
+		for l, nodes := range tree.nodes {
+			if len(nodes) > len(leaves) {
+				t.Fatalf("depth %d: level %d holds %d nodes over %d leaves", depth, l, len(nodes), len(leaves))
+			}
+		}
+	}
+}
+
+func TestOperatorProofMatchesRebuild(t *testing.T) {
+	op, privs := newTestOperator(t, 8)
+	var empty Account
+	empty.Reset()
+	for _, p := range []Index{indexOf(t, op, privs[0]), indexOf(t, op, privs[7]), {}} {
+		got := op.Proof(p)
+		want := rebuildProof(op.h, StateDepth, accountLeaves(op), empty.Hash(op.h), p)
+		if !bytes.Equal(got.RootHash, want.RootHash) || len(got.Path) != StateDepth+1 || !verifyProof(op.h, got) {
+			t.Fatalf("leaf %s: operator proof differs from the rebuilt one", p)
+		}
+	}
+}
+
+// membershipCircuit checks one operator proof with gadget.VerifyMembership.
+type membershipCircuit struct {
+	Account AccountConstraints
+	Path    gadget.MerklePath
+	Root    frontend.Variable `gnark:",public"`
+	suite   HashSuite
+}
+
+func (c *membershipCircuit) Define(api frontend.API) error {
+	h, err := c.suite.circuitHasher(api)
+	if err != nil {
+		return err
+	}
+	gadget.VerifyMembership(api, h, c.Account, c.Path, c.Root)
+	return nil
+}
+
+func TestOperatorProofVerifiesMembership(t *testing.T) {
+	for _, suite := range []HashSuite{MiMC, Poseidon2} {
+		r := rand.New(rand.NewSource(9)) //#nosec G404 -- deterministic test
+		op, privs := addAccounts(t, NewOperator(suite.New()), 8, 10, r)
+		acc := accountOf(t, op, privs[3])
+		p := op.Proof(acc.Index)
+
+		circuit := &membershipCircuit{Account: newAccounts(1)[0], Path: gadget.NewMerklePath(len(p.Path) - 1), suite: suite}
+		assignment := &membershipCircuit{Account: newAccounts(1)[0], Root: p.RootHash}
+		assignAccount(&assignment.Account, acc)
+		assignPath(&assignment.Path, p)
+		if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+			t.Fatalf("%s: operator proof should satisfy VerifyMembership: %v", suite, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package rollup
+
+import "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+
+// StateView reads an operator's state as of one point in time; see
+// Operator.View.
+type StateView struct {
+	o *Operator
+}
+
+// View calls fn with a StateView of the current state and returns fn's error.
+// No write happens while fn runs, so all of its reads are consistent with one
+// another (a proof matches the root, balances add up across accounts). fn must
+// not call the operator's own methods: a writer waiting for the lock would
+// deadlock them.
+func (o *Operator) View(fn func(StateView) error) error {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return fn(StateView{o: o})
+}
+
+// ReadAccount returns the account stored at index i, the empty account if
+// there is none.
+func (v StateView) ReadAccount(i Index) Account {
+	return v.o.readAccount(i)
+}
+
+// Root returns the state root.
+func (v StateView) Root() ([]byte, error) {
+	return v.o.root()
+}
+
+// Proof returns the Merkle inclusion proof of the account at index i.
+func (v StateView) Proof(i Index) MerkleProofData {
+	return v.o.proof(i)
+}
+
+// AccountIndex returns the index of the account owned by pub.
+func (v StateView) AccountIndex(pub eddsa.PublicKey) (Index, bool) {
+	return v.o.accountIndex(pub)
+}
+
+// Proof returns the Merkle inclusion proof of the account at index i against
+// the current root.
+func (o *Operator) Proof(i Index) MerkleProofData {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.proof(i)
+}
+
+// AccountIndex returns the index of the account owned by pub.
+func (o *Operator) AccountIndex(pub eddsa.PublicKey) (Index, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.accountIndex(pub)
+}
+
+// accountIndex is AccountIndex without locking.
+func (o *Operator) accountIndex(pub eddsa.PublicKey) (Index, bool) {
+	i, ok := o.accountMap[accountKey(pub)]
+	return i, ok
+}
+
+// accountKey returns the accountMap key of pub: its compressed encoding, which
+// determines the whole point.
+func accountKey(pub eddsa.PublicKey) string {
+	return string(pub.Bytes())
+}
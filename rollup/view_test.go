@@ -0,0 +1,100 @@
+package rollup
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	chash "github.com/consensys/gnark-crypto/hash"
+)
+
+// TestOperatorConcurrentReaders applies transfers from one goroutine while
+// many others read the state. Run it under the race detector (`make race`).
+// Within a View, the two parties' balances always add up and every proof
+// matches the root and the account it is read for.
+func TestOperatorConcurrentReaders(t *testing.T) {
+	op, privs := newBatchOperator(t, 16)
+	acc0 := accountOf(t, op, privs[0])
+	acc1 := accountOf(t, op, privs[1])
+	parties := []Index{acc0.Index, acc1.Index}
+	var total fr.Element
+	total.Add(&acc0.Balances[FeeToken], &acc1.Balances[FeeToken])
+
+	done := make(chan struct{})
+	errs := make(chan error, 16)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := cmimc.NewMiMC()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if acc := op.ReadAccount(acc1.Index); acc.Index != acc1.Index {
+					errs <- errors.New("read another account than the one asked for")
+					return
+				}
+				if p := op.Proof(acc1.Index); p.Index != acc1.Index {
+					errs <- errors.New("proved another leaf than the one asked for")
+					return
+				}
+				if _, ok := op.AccountIndex(acc1.PubKey); !ok {
+					errs <- ErrNonExistingAccount
+					return
+				}
+				if err := op.View(func(v StateView) error {
+					return checkView(v, h, parties, &total)
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for k := 0; k < 30; k++ {
+		sender := accountOf(t, op, privs[0])
+		transfer := NewTransfer(1, acc0.PubKey, acc1.PubKey, sender.Nonce)
+		if _, err := transfer.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+			t.Fatalf("sign %d: %v", k, err)
+		}
+		if _, err := op.ApplyTransfer(transfer); err != nil {
+			t.Fatalf("apply %d: %v", k, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// checkView checks that the accounts at indexes hold total between them and
+// that their proofs match the view's root and leaves.
+func checkView(v StateView, h chash.StateStorer, indexes []Index, total *fr.Element) error {
+	root, err := v.Root()
+	if err != nil {
+		return err
+	}
+	var sum fr.Element
+	for _, i := range indexes {
+		acc := v.ReadAccount(i)
+		sum.Add(&sum, &acc.Balances[FeeToken])
+		p := v.Proof(i)
+		if !bytes.Equal(p.RootHash, root) || !bytes.Equal(p.Path[0], acc.Hash(h)) {
+			return errors.New("proof does not match the view's root and account")
+		}
+	}
+	if !sum.Equal(total) {
+		return errors.New("balances do not add up within a view")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package rollup
+
+import (
+	"hash"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/twistededwards/eddsa"
+)
+
+// Withdrawal moves value out of the rollup: it debits Amount of token TokenID
+// from the sender's account and pays it to the L1 address Recipient. It is
+// signed by the sender over the hash of (TxWithdrawal || domain || nonce ||
+// tokenID || amount || senderPubKey || recipient) and consumes the sender's
+// nonce like a transfer, so it cannot be replayed.
+type Withdrawal struct {
+	Domain       Domain // the deployment the withdrawal is signed for
+	Nonce        uint64
+	TokenID      uint64
+	Amount       fr.Element
+	SenderPubKey eddsa.PublicKey
+	Recipient    [20]byte // L1 address paid by the bridge
+
+	// SignatureRaw is the serialized signature under the rollup's Authorizer.
+	SignatureRaw []byte
+}
+
+// Exit is the L1 payout a proven withdrawal entitles: Amount of token TokenID to
+// Recipient.
+type Exit struct {
+	Recipient [20]byte
+	TokenID   uint64
+	Amount    fr.Element
+}
+
+// NewWithdrawal creates an unsigned withdrawal of amount of FeeToken from the
+// owner of from to the L1 address to, for the zero Domain. Set TokenID and
+// Domain before signing to withdraw another token or to sign for another
+// deployment.
+func NewWithdrawal(amount uint64, from eddsa.PublicKey, to [20]byte, nonce uint64) Withdrawal {
+	var wd Withdrawal
+	wd.Nonce = nonce
+	wd.Amount.SetUint64(amount)
+	wd.SenderPubKey = from
+	wd.Recipient = to
+	return wd
+}
+
+// Exit returns the payout this withdrawal entitles.
+func (wd *Withdrawal) Exit() Exit {
+	return Exit{Recipient: wd.Recipient, TokenID: wd.TokenID, Amount: wd.Amount}
+}
+
+// preimage returns the message that is signed/verified: the hash of
+// TxWithdrawal || chainID || instanceID || nonce || tokenID || amount ||
+// senderX || senderY || recipient.
+func (wd *Withdrawal) preimage(h hash.Hash) []byte {
+	var to fr.Element
+	to.SetBytes(wd.Recipient[:])
+	elems := append(wd.Domain.elements(TxWithdrawal), toElem(wd.Nonce), toElem(wd.TokenID), wd.Amount, wd.SenderPubKey.A.X, wd.SenderPubKey.A.Y, to)
+	m := hashElements(h, elems...)
+	return m.Marshal()
+}
+
+// Sign signs the withdrawal with priv under EdDSA and stores the signature on
+// it. It returns the raw signature bytes. h must be a hasher of the rollup's
+// HashSuite.
+func (wd *Withdrawal) Sign(priv eddsa.PrivateKey, h hash.Hash) ([]byte, error) {
+	return wd.SignWith(EdDSA{}, priv, h)
+}
+
+// SignWith is Sign under the Authorizer a, which must be the rollup's.
+func (wd *Withdrawal) SignWith(a Authorizer, priv eddsa.PrivateKey, h hash.Hash) ([]byte, error) {
+	return sign(a, priv, wd.preimage(h), h, &wd.SignatureRaw)
+}
+
+// Verify checks the withdrawal's EdDSA signature against its sender public key.
+func (wd *Withdrawal) Verify(h hash.Hash) (bool, error) {
+	return wd.VerifyWith(EdDSA{}, h)
+}
+
+// VerifyWith is Verify under the Authorizer a.
+func (wd *Withdrawal) VerifyWith(a Authorizer, h hash.Hash) (bool, error) {
+	return verify(a, wd.SenderPubKey, wd.SignatureRaw, wd.preimage(h), h)
+}
+
+// WithdrawalHash chains a batch's exits, in order, into the withdrawal
+// commitment exposed by Circuit.WithdrawalHash:
+//
+//	e_0 = 0, e_k = H(e_{k-1} || recipient || tokenID || amount)
+//
+// A bridge recomputes it over the exits it is about to pay for a verified batch.
+// The hasher is reset before use.
+func WithdrawalHash(exits []Exit, h hash.Hash) []byte {
+	var acc fr.Element
+	for _, e := range exits {
+		var to fr.Element
+		to.SetBytes(e.Recipient[:])
+		acc = hashElements(h, acc, to, toElem(e.TokenID), e.Amount)
+	}
+	b := acc.Bytes()
+	return b[:]
+}
@@ -0,0 +1,98 @@
+package rollup
+
+import (
+	"bytes"
+	"testing"
+
+	cmimc "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+)
+
+var testRecipient = [20]byte{0xde, 0xad, 0xbe, 0xef}
+
+func TestWithdrawalSignVerify(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	acc := accountOf(t, op, privs[0])
+	h := cmimc.NewMiMC()
+
+	wd := NewWithdrawal(5, acc.PubKey, testRecipient, acc.Nonce)
+	if _, err := wd.Sign(privs[0], h); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, err := wd.Verify(h); err != nil || !ok {
+		t.Fatalf("expected valid signature, got ok=%v err=%v", ok, err)
+	}
+
+	// Redirecting the payout after signing must invalidate the signature.
+	wd.Recipient[0] ^= 1
+	if ok, _ := wd.Verify(h); ok {
+		t.Fatal("withdrawal with a changed recipient should not verify")
+	}
+}
+
+func TestApplyWithdrawal(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	acc := accountOf(t, op, privs[2]) // balance 22
+
+	wd := NewWithdrawal(7, acc.PubKey, testRecipient, acc.Nonce)
+	if _, err := wd.Sign(privs[2], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	w, err := op.ApplyWithdrawal(wd)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	got := accountOf(t, op, privs[2])
+	want := newElem(15)
+	if !got.Balances[FeeToken].Equal(&want) || got.Nonce != acc.Nonce+1 {
+		t.Fatal("withdrawal must debit the amount and bump the nonce")
+	}
+	if w.Type != TxWithdrawal || w.Recipient != testRecipient {
+		t.Fatal("witness does not describe the withdrawal")
+	}
+	if root, _ := op.Root(); !bytes.Equal(root, w.RootAfter) {
+		t.Fatal("witness RootAfter does not match the operator root")
+	}
+
+	// The same signed withdrawal cannot be applied twice.
+	if _, err := op.ApplyWithdrawal(wd); err != ErrNonce {
+		t.Fatalf("replay: expected ErrNonce, got %v", err)
+	}
+}
+
+func TestApplyWithdrawalRejects(t *testing.T) {
+	op, privs := newTestOperator(t, 4)
+	acc := accountOf(t, op, privs[0]) // balance 20
+
+	overdraft := NewWithdrawal(21, acc.PubKey, testRecipient, acc.Nonce)
+	if _, err := overdraft.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyWithdrawal(overdraft); err != ErrAmountTooHigh {
+		t.Fatalf("overdraft: expected ErrAmountTooHigh, got %v", err)
+	}
+
+	wide := NewWithdrawal(0, acc.PubKey, testRecipient, acc.Nonce)
+	wide.Amount.SetUint64(1 << 63).Double(&wide.Amount) // 2^BalanceBits
+	if _, err := wide.Sign(privs[0], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyWithdrawal(wide); err != ErrBalanceOverflow {
+		t.Fatalf("amount at 2^BalanceBits: expected ErrBalanceOverflow, got %v", err)
+	}
+
+	forged := NewWithdrawal(1, acc.PubKey, testRecipient, acc.Nonce)
+	if _, err := forged.Sign(privs[1], cmimc.NewMiMC()); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := op.ApplyWithdrawal(forged); err != ErrWrongSignature {
+		t.Fatalf("foreign key: expected ErrWrongSignature, got %v", err)
+	}
+
+	// (x, -y) shares the account's X coordinate, but is another key
+	mirrored := acc.PubKey
+	mirrored.A.Y.Neg(&mirrored.A.Y)
+	if _, err := op.ApplyWithdrawal(NewWithdrawal(1, mirrored, testRecipient, acc.Nonce)); err != ErrNonExistingAccount {
+		t.Fatalf("key sharing X: expected ErrNonExistingAccount, got %v", err)
+	}
+}